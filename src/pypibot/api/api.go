@@ -1,42 +1,318 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
+	"pypibot/authz"
+	"pypibot/metrics"
+	"pypibot/rpc"
 	"pypibot/store"
 )
 
-type userResp struct {
-	*store.User
-	Key string `json:"pub-key"`
+type enrollReq struct {
+	Token string `json:"token"`
+	Csr   string `json:"csr"`
+}
+
+type enrollResp struct {
+	Crt string `json:"crt"`
+	Ca  string `json:"ca"`
+}
+
+type sessionResp struct {
+	Id          string    `json:"id"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	RemoteAddr  string    `json:"remote-addr"`
+	Connected   time.Time `json:"connected"`
+	LastActive  time.Time `json:"last-active"`
+	TlsVersion  string    `json:"tls-version"`
+	CipherSuite string    `json:"cipher-suite"`
+	ServerName  string    `json:"server-name"`
+	Serial      string    `json:"serial"`
+	Status      string    `json:"status,omitempty"`
+}
+
+type errorResp struct {
+	Error string `json:"error"`
 }
 
 func writeJson(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
-		log.Panic(err)
+		// the status has been sent, so all that is left is to log it.
+		log.Print(err)
+	}
+}
+
+// writeError sends msg as a JSON error body.
+func writeError(w http.ResponseWriter, msg string, status int) {
+	writeJson(w, &errorResp{
+		Error: msg,
+	}, status)
+}
+
+// internalErrorMessage is all that callers are told of internal errors,
+// whose detail may reveal the server's internals. The detail is logged
+// instead.
+const internalErrorMessage = "internal error"
+
+// writeInternalError logs err and responds with internalErrorMessage.
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Print(err)
+	writeError(w, internalErrorMessage, http.StatusInternalServerError)
+}
+
+// Authenticator identifies the user making a request, returning the user's id
+// along with the user.
+type Authenticator func(r *http.Request) ([]byte, *store.User, error)
+
+// CertAuthenticator identifies users by the client cert they presented over
+// TLS.
+func CertAuthenticator(s *store.Store) Authenticator {
+	return func(r *http.Request) ([]byte, *store.User, error) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return nil, nil, errors.New("no client certificate")
+		}
+		return s.Authenticate(r.TLS.PeerCertificates)
+	}
+}
+
+// TokenAuthenticator identifies users by a bearer token in the Authorization
+// header, as issued by store.IssueToken. Tokens are only accepted over TLS.
+func TokenAuthenticator(s *store.Store) Authenticator {
+	return func(r *http.Request) ([]byte, *store.User, error) {
+		h := r.Header.Get("Authorization")
+		if !strings.HasPrefix(h, "Bearer ") {
+			return nil, nil, errors.New("no bearer token")
+		}
+
+		if r.TLS == nil {
+			return nil, nil, errors.New("bearer tokens require TLS")
+		}
+
+		return s.FindUserByToken(strings.TrimPrefix(h, "Bearer "))
+	}
+}
+
+// StoreAuthenticator identifies users by a bearer token if the request
+// carries one and otherwise by their client cert.
+func StoreAuthenticator(s *store.Store) Authenticator {
+	token, cert := TokenAuthenticator(s), CertAuthenticator(s)
+	return func(r *http.Request) ([]byte, *store.User, error) {
+		if r.Header.Get("Authorization") != "" {
+			return token(r)
+		}
+		return cert(r)
+	}
+}
+
+// requireTLS refuses requests that did not arrive over TLS, for routes whose
+// responses hold secrets. It reports whether the request may proceed.
+func requireTLS(w http.ResponseWriter, r *http.Request) bool {
+	if r.TLS == nil {
+		writeError(w, "TLS is required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// caller is the authenticated user making a request.
+type caller struct {
+	id   []byte
+	user *store.User
+}
+
+type ctxKey int
+
+const callerKey ctxKey = 0
+
+// callerOf returns the user authenticated by restrict.
+func callerOf(r *http.Request) *caller {
+	return r.Context().Value(callerKey).(*caller)
+}
+
+// audit records an event in the audit log. Failures are only logged since
+// the request has either been served or been refused already.
+func audit(s *store.Store, e *store.AuditEntry) {
+	if err := s.Audit(e); err != nil {
+		log.Print(err)
 	}
 }
 
-func Install(r *http.ServeMux, s *store.Store) {
-	r.HandleFunc("/api/v1/users", func(w http.ResponseWriter, r *http.Request) {
-		var users []*userResp
+// restrict wraps h so that it is only called for authenticated users
+// permitted by policy. Failures to authenticate with credentials that were
+// presented are audited, as are requests to privileged routes other than
+// GETs, whether permitted or not.
+func restrict(s *store.Store, authn Authenticator, policy authz.Policy, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, user, err := authn(r)
+		if err != nil {
+			var certs []*x509.Certificate
+			if r.TLS != nil {
+				certs = r.TLS.PeerCertificates
+			}
+			if len(certs) > 0 || r.Header.Get("Authorization") != "" {
+				if err := s.AuditAuthFailure(r.RemoteAddr, certs, err); err != nil {
+					log.Print(err)
+				}
+			}
+			writeError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		detail := r.Method + " " + r.URL.Path
+		err = policy.Check(user)
+		if err != nil {
+			detail += ": " + err.Error()
+		}
+
+		if policy.Privileged() && r.Method != "GET" {
+			audit(s, &store.AuditEntry{
+				Event:      store.AuditApi,
+				Actor:      id,
+				RemoteAddr: r.RemoteAddr,
+				Detail:     detail,
+			})
+		}
+
+		if err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), callerKey, &caller{
+			id:   id,
+			user: user,
+		})))
+	}
+}
+
+// byMethod routes requests to the handler for their method.
+func byMethod(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := handlers[r.Method]
+		if !ok {
+			writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Install adds the api's routes to r. Other than enrollment, which is
+// authorized by its token, every route requires a user identified by authn
+// and permitted by the route's policy.
+func Install(r *http.ServeMux, s *store.Store, srv *rpc.Server, authn Authenticator) {
+	r.HandleFunc("/api/v1/users", byMethod(map[string]http.HandlerFunc{
+		"GET":  restrict(s, authn, authz.Admins, listUsers(s, srv)),
+		"POST": restrict(s, authn, authz.Admins, createUser(s)),
+	}))
+
+	// users may look themselves up, see getUser.
+	r.HandleFunc("/api/v1/users/", byMethod(map[string]http.HandlerFunc{
+		"GET":    restrict(s, authn, authz.Anyone, getUser(s, srv)),
+		"PATCH":  restrict(s, authn, authz.Admins, updateUser(s, srv)),
+		"DELETE": restrict(s, authn, authz.Admins, deleteUser(s)),
+	}))
+
+	r.HandleFunc("/api/v1/sessions", byMethod(map[string]http.HandlerFunc{
+		"GET": restrict(s, authn, authz.Admins, listSessions(srv)),
+	}))
+
+	r.HandleFunc("/api/v1/audit", byMethod(map[string]http.HandlerFunc{
+		"GET": restrict(s, authn, authz.Admins, listAudit(s)),
+	}))
+
+	r.HandleFunc("/api/v1/backup", byMethod(map[string]http.HandlerFunc{
+		"GET": restrict(s, authn, authz.Admins, backup(s)),
+	}))
+
+	r.HandleFunc("/api/v1/enroll", byMethod(map[string]http.HandlerFunc{
+		"POST": enroll(s),
+	}))
+
+	// metrics hold only counts, so any user may scrape them, such as a bot
+	// with a token.
+	r.HandleFunc("/metrics", byMethod(map[string]http.HandlerFunc{
+		"GET": restrict(s, authn, authz.Anyone, metrics.Handler().ServeHTTP),
+	}))
+}
+
+func listSessions(srv *rpc.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessions := []*sessionResp{}
 
-		if err := s.ForEachUser(func(key []byte, user *store.User) error {
-			u := *user
-			users = append(users, &userResp{
-				User: &u,
-				Key:  hex.EncodeToString(key),
+		for _, ss := range srv.Sessions() {
+			sessions = append(sessions, &sessionResp{
+				Id:          hex.EncodeToString(ss.Uid),
+				Email:       ss.User.Email,
+				Name:        ss.User.Name,
+				Type:        ss.User.Type.String(),
+				RemoteAddr:  ss.RemoteAddr,
+				Connected:   ss.Connected,
+				LastActive:  ss.LastActive,
+				TlsVersion:  tls.VersionName(ss.TlsVersion),
+				CipherSuite: tls.CipherSuiteName(ss.CipherSuite),
+				ServerName:  ss.ServerName,
+				Serial:      ss.Serial,
+				Status:      ss.Status,
 			})
-			return nil
-		}); err != nil {
-			log.Panic(err)
 		}
 
-		writeJson(w, users, http.StatusOK)
-	})
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].Connected.Before(sessions[j].Connected)
+		})
+
+		writeJson(w, sessions, http.StatusOK)
+	}
+}
+
+func enroll(s *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req enrollReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		csrPem, _ := pem.Decode([]byte(req.Csr))
+		if csrPem == nil {
+			writeError(w, "invalid csr", http.StatusBadRequest)
+			return
+		}
+
+		_, crtPem, err := s.EnrollUser(req.Token, csrPem)
+		if err == store.ErrInvalidToken {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		caPem, err := s.CACert()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeJson(w, &enrollResp{
+			Crt: string(pem.EncodeToMemory(crtPem)),
+			Ca:  string(pem.EncodeToMemory(caPem)),
+		}, http.StatusOK)
+	}
 }
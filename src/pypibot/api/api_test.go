@@ -0,0 +1,623 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"pypibot/auth"
+	"pypibot/rpc"
+	"pypibot/store"
+)
+
+// newTestApi serves the api backed by a new store. Requests are authenticated
+// as a user of the type named in the X-User-Type header.
+func newTestApi(t *testing.T) (*httptest.Server, func()) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(tmp, "data")
+
+	if err := store.Create(data, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// let the rpc tests have their fixed port.
+	s.Config.Rpc.Addr = "127.0.0.1:0"
+
+	srv, err := rpc.Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := map[string]*store.User{}
+	for _, typ := range []store.User_UserType{
+		store.User_PERSON,
+		store.User_BOT,
+		store.User_GOD,
+	} {
+		user, _, _, err := s.CreateUser(typ.String()+"@email.com", "foo", typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[typ.String()] = user
+	}
+
+	r := http.NewServeMux()
+	Install(r, s, srv, func(r *http.Request) ([]byte, *store.User, error) {
+		user := users[r.Header.Get("X-User-Type")]
+		if user == nil {
+			return nil, nil, errors.New("unknown user")
+		}
+		return user.Id, user, nil
+	})
+
+	h := httptest.NewTLSServer(r)
+	testClient = h.Client()
+	return h, func() {
+		h.Close()
+		srv.Close()
+		s.Close()
+		os.RemoveAll(tmp)
+	}
+}
+
+// testClient trusts the server started by newTestApi.
+var testClient *http.Client
+
+func get(t *testing.T, url, userType string) int {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if userType != "" {
+		req.Header.Set("X-User-Type", userType)
+	}
+
+	res, err := testClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestAuthorization(t *testing.T) {
+	h, done := newTestApi(t)
+	defer done()
+
+	for _, path := range []string{
+		"/api/v1/users",
+		"/api/v1/sessions",
+		"/api/v1/audit",
+		"/api/v1/backup",
+	} {
+		for userType, status := range map[string]int{
+			"":       http.StatusUnauthorized,
+			"PERSON": http.StatusForbidden,
+			"BOT":    http.StatusForbidden,
+			"GOD":    http.StatusOK,
+		} {
+			if s := get(t, h.URL+path, userType); s != status {
+				t.Fatalf("%s as %q: expected %d, got %d", path, userType, status, s)
+			}
+		}
+	}
+
+	// enrollment is authorized by its token rather than the user.
+	if s := get(t, h.URL+"/api/v1/enroll", ""); s != http.StatusMethodNotAllowed {
+		t.Fatalf("enroll: expected %d, got %d", http.StatusMethodNotAllowed, s)
+	}
+}
+
+func TestCertAndTokenAuth(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	if err := store.Create(data, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Config.Rpc.Addr = "127.0.0.1:0"
+
+	srv, err := rpc.Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	god, crtPem, keyPem, err := s.CreateUser("god@email.com", "god", store.User_GOD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.IssueToken(god.Id, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := s.WebTlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := http.NewServeMux()
+	Install(r, s, srv, StoreAuthenticator(s))
+
+	h := httptest.NewUnstartedServer(r)
+	h.TLS = cfg
+	h.StartTLS()
+	defer h.Close()
+
+	caPem, err := s.CACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCrt, err := x509.ParseCertificate(caPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := x509.NewCertPool()
+	p.AddCert(caCrt)
+
+	prv, err := auth.ParsePrivateKey(keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      p,
+					ServerName:   "localhost",
+					Certificates: certs,
+				},
+			},
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		c      *http.Client
+		token  string
+		status int
+	}{
+		{"anonymous", newClient(), "", http.StatusUnauthorized},
+		{"cert", newClient(tls.Certificate{
+			Certificate: [][]byte{crtPem.Bytes},
+			PrivateKey:  prv,
+		}), "", http.StatusOK},
+		{"token", newClient(), token, http.StatusOK},
+		{"bad token", newClient(), "bogus", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest("GET", h.URL+"/api/v1/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		res, err := test.c.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.status, res.StatusCode)
+		}
+	}
+
+	// tokens are refused, as they were already exposed, without TLS.
+	plain := httptest.NewServer(r)
+	defer plain.Close()
+
+	req, err := http.NewRequest("GET", plain.URL+"/api/v1/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token without TLS: expected %d, got %d", http.StatusUnauthorized, res.StatusCode)
+	}
+}
+
+func do(t *testing.T, method, url, userType, body string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if userType != "" {
+		req.Header.Set("X-User-Type", userType)
+	}
+
+	res, err := testClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, b
+}
+
+func TestUserApi(t *testing.T) {
+	h, done := newTestApi(t)
+	defer done()
+
+	res, b := do(t, "POST", h.URL+"/api/v1/users", "PERSON", `{"email": "new@email.com", "name": "new"}`)
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("person created a user: %d", res.StatusCode)
+	}
+
+	res, b = do(t, "POST", h.URL+"/api/v1/users", "GOD", `{"email": "new@email.com", "name": "new", "type": "bot"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, res.StatusCode, b)
+	}
+
+	crtPem, rest := pem.Decode(b)
+	keyPem, _ := pem.Decode(rest)
+	if crtPem == nil || crtPem.Type != "CERTIFICATE" || keyPem == nil {
+		t.Fatalf("expected a cert and key bundle, got %s", b)
+	}
+
+	loc := h.URL + res.Header.Get("Location")
+
+	var user struct {
+		Email string `json:"email"`
+		Name  string `json:"name"`
+		Type  int    `json:"type"`
+		Id    string `json:"id"`
+	}
+
+	res, b = do(t, "GET", loc, "GOD", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.StatusCode, b)
+	}
+
+	if err := json.Unmarshal(b, &user); err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Email != "new@email.com" || user.Type != int(store.User_BOT) {
+		t.Fatalf("unexpected user: %s", b)
+	}
+
+	// users other than admins may only look themselves up.
+	if res, _ := do(t, "GET", loc, "PERSON", ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("person looked up another user: %d", res.StatusCode)
+	}
+
+	var users []struct {
+		Email string `json:"email"`
+		Id    string `json:"id"`
+	}
+	_, b = do(t, "GET", h.URL+"/api/v1/users", "GOD", "")
+	if err := json.Unmarshal(b, &users); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range users {
+		if u.Email == "PERSON@email.com" {
+			if res, b := do(t, "GET", h.URL+"/api/v1/users/"+u.Id, "PERSON", ""); res.StatusCode != http.StatusOK {
+				t.Fatalf("person could not look themselves up: %d: %s", res.StatusCode, b)
+			}
+		}
+	}
+
+	if res, _ := do(t, "PATCH", loc, "BOT", `{"name": "renamed"}`); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("bot modified a user: %d", res.StatusCode)
+	}
+
+	res, b = do(t, "PATCH", loc, "GOD", `{"name": "renamed", "type": "PERSON"}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.StatusCode, b)
+	}
+
+	// the type is omitted from the JSON when it is PERSON.
+	user.Type = 0
+	if err := json.Unmarshal(b, &user); err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Email != "new@email.com" || user.Name != "renamed" || user.Type != int(store.User_PERSON) {
+		t.Fatalf("unexpected user after update: %s", b)
+	}
+
+	if res, _ := do(t, "DELETE", loc, "GOD", ""); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, res.StatusCode)
+	}
+
+	if res, _ := do(t, "DELETE", loc, "GOD", ""); res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected %d, got %d", http.StatusConflict, res.StatusCode)
+	}
+
+	for path, status := range map[string]int{
+		"/api/v1/users/zz":   http.StatusBadRequest,
+		"/api/v1/users/0102": http.StatusNotFound,
+	} {
+		res, b := do(t, "GET", h.URL+path, "GOD", "")
+		if res.StatusCode != status {
+			t.Fatalf("%s: expected %d, got %d", path, status, res.StatusCode)
+		}
+
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(b, &e); err != nil || e.Error == "" {
+			t.Fatalf("%s: expected a JSON error, got %s", path, b)
+		}
+	}
+}
+
+func TestListUsersPages(t *testing.T) {
+	h, done := newTestApi(t)
+	defer done()
+
+	list := func(query string) ([]string, string) {
+		res, b := do(t, "GET", h.URL+"/api/v1/users?"+query, "GOD", "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected %d, got %d: %s", query, http.StatusOK, res.StatusCode, b)
+		}
+
+		var users []struct {
+			Email string `json:"email"`
+		}
+		if err := json.Unmarshal(b, &users); err != nil {
+			t.Fatal(err)
+		}
+
+		var emails []string
+		for _, u := range users {
+			emails = append(emails, u.Email)
+		}
+
+		return emails, res.Header.Get("Link")
+	}
+
+	all, link := list("")
+	if len(all) != 3 || link != "" {
+		t.Fatalf("expected 3 users on one page, got %v, %q", all, link)
+	}
+
+	if !sort.StringsAreSorted(all) {
+		t.Fatalf("expected users in order of email, got %v", all)
+	}
+
+	page, link := list("limit=2")
+	if len(page) != 2 || link == "" {
+		t.Fatalf("expected a page of 2 users with a next link, got %v, %q", page, link)
+	}
+
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "</api/v1/users?"), `>; rel="next"`)
+	rest, link := list(next)
+	if len(rest) != 1 || link != "" || rest[0] != all[2] {
+		t.Fatalf("expected the last user, got %v, %q", rest, link)
+	}
+
+	desc, _ := list("order=desc")
+	if len(desc) != 3 || desc[0] != all[2] || desc[2] != all[0] {
+		t.Fatalf("expected users in descending order, got %v", desc)
+	}
+
+	for query, expected := range map[string]string{
+		"type=bot":             "BOT@email.com",
+		"email=GoD":            "GOD@email.com",
+		"name=foo&type=PERSON": "PERSON@email.com",
+	} {
+		users, _ := list(query)
+		if len(users) != 1 || users[0] != expected {
+			t.Fatalf("%s: expected %s, got %v", query, expected, users)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "order=up", "type=cat"} {
+		if res, _ := do(t, "GET", h.URL+"/api/v1/users?"+query, "GOD", ""); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d, got %d", query, http.StatusBadRequest, res.StatusCode)
+		}
+	}
+}
+
+func TestAuditApi(t *testing.T) {
+	h, done := newTestApi(t)
+	defer done()
+
+	if res, b := do(t, "POST", h.URL+"/api/v1/users", "GOD", `{"email": "new@email.com", "name": "new"}`); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, res.StatusCode, b)
+	}
+
+	if res, _ := do(t, "POST", h.URL+"/api/v1/users", "", `{}`); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got %d", http.StatusUnauthorized, res.StatusCode)
+	}
+
+	// only failures with credentials are audited, and only the first from
+	// a host within a while.
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", h.URL+"/api/v1/users", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer bogus")
+
+		res, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected %d, got %d", http.StatusUnauthorized, res.StatusCode)
+		}
+	}
+
+	list := func(query string) []string {
+		res, b := do(t, "GET", h.URL+"/api/v1/audit?"+query, "GOD", "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected %d, got %d: %s", query, http.StatusOK, res.StatusCode, b)
+		}
+
+		var entries []struct {
+			Seq   uint64 `json:"seq"`
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(b, &entries); err != nil {
+			t.Fatal(err)
+		}
+
+		var events []string
+		for _, e := range entries {
+			events = append(events, e.Event)
+		}
+		return events
+	}
+
+	// the test users, then the request and the user it created, then the
+	// first failed request with credentials.
+	events := list("")
+	if len(events) != 6 ||
+		events[3] != store.AuditApi ||
+		events[4] != store.AuditUserCreated ||
+		events[5] != store.AuditAuthFailure {
+		t.Fatalf("unexpected audit log: %v", events)
+	}
+
+	if events := list("event=user-created&after=1"); len(events) != 3 {
+		t.Fatalf("expected 3 user-created entries after the first, got %v", events)
+	}
+}
+
+func TestBackupApi(t *testing.T) {
+	h, done := newTestApi(t)
+	defer done()
+
+	res, b := do(t, "GET", h.URL+"/api/v1/backup", "GOD", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.StatusCode, b)
+	}
+
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+	if err := store.Restore(bytes.NewReader(b), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, _, err := s.FindUserByEmail("GOD@email.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInternalErrorsHidden(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeInternalError(w, errors.New("open /secret/path/user.db: permission denied"))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	var res errorResp
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Error != internalErrorMessage {
+		t.Fatalf("expected %q, got %q", internalErrorMessage, res.Error)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	for name, h := range map[string]http.HandlerFunc{
+		"backup":      backup(nil),
+		"create user": createUser(nil),
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/", strings.NewReader(`{}`)))
+
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected %d, got %d", name, http.StatusForbidden, w.Code)
+		}
+	}
+}
+
+func TestMetricsApi(t *testing.T) {
+	h, done := newTestApi(t)
+	defer done()
+
+	if s := get(t, h.URL+"/metrics", ""); s != http.StatusUnauthorized {
+		t.Fatalf("expected %d, got %d", http.StatusUnauthorized, s)
+	}
+
+	res, b := do(t, "GET", h.URL+"/metrics", "BOT", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.StatusCode, b)
+	}
+
+	for _, line := range []string{
+		"# TYPE pypibot_rpc_accepts_total counter",
+		"# TYPE pypibot_rpc_request_duration_seconds histogram",
+		"# TYPE pypibot_rpc_sessions gauge",
+		`pypibot_store_op_duration_seconds_bucket{op="write",le="+Inf"}`,
+	} {
+		if !strings.Contains(string(b), line) {
+			t.Fatalf("expected %q in:\n%s", line, b)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"pypibot/store"
+)
+
+type auditResp struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Actor      string    `json:"actor,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	RemoteAddr string    `json:"remote-addr,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Prev       string    `json:"prev"`
+}
+
+func newAuditResp(e *store.AuditEntry) *auditResp {
+	return &auditResp{
+		Seq:        e.Seq,
+		Time:       time.Unix(0, e.Time).UTC(),
+		Event:      e.Event,
+		Actor:      hex.EncodeToString(e.Actor),
+		Subject:    hex.EncodeToString(e.Subject),
+		RemoteAddr: e.RemoteAddr,
+		Detail:     e.Detail,
+		Prev:       hex.EncodeToString(e.Prev),
+	}
+}
+
+// listAudit responds with a page of the audit log in order. The query may
+// contain:
+//
+//	limit  the number of entries per page, at most 1000
+//	after  the sequence number of the last entry of the previous page
+//	event  the kind of entries to list
+//
+// If there are more entries, the Link header points to the next page.
+func listAudit(s *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		limit := defaultPageSize
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxPageSize {
+				writeError(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		var after uint64
+		if v := q.Get("after"); v != "" {
+			var err error
+			if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+				writeError(w, "invalid after", http.StatusBadRequest)
+				return
+			}
+		}
+
+		event := q.Get("event")
+
+		entries := []*auditResp{}
+		more := false
+
+		if err := s.ForEachAuditEntry(after, func(e *store.AuditEntry) error {
+			if event != "" && e.Event != event {
+				return nil
+			}
+
+			if len(entries) == limit {
+				more = true
+				return errPageFull
+			}
+
+			entries = append(entries, newAuditResp(e))
+			return nil
+		}); err != nil && err != errPageFull {
+			writeInternalError(w, err)
+			return
+		}
+
+		if more {
+			q.Set("after", strconv.FormatUint(entries[len(entries)-1].Seq, 10))
+			w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, q.Encode()))
+		}
+
+		writeJson(w, entries, http.StatusOK)
+	}
+}
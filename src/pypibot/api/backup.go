@@ -0,0 +1,36 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"pypibot/store"
+)
+
+// backup responds with an archive of the store made by store.Backup. Since
+// the archive holds the CA key, it is only sent over TLS and every backup is
+// audited.
+func backup(s *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireTLS(w, r) {
+			return
+		}
+
+		audit(s, &store.AuditEntry{
+			Event:      store.AuditBackup,
+			Actor:      callerOf(r).id,
+			RemoteAddr: r.RemoteAddr,
+		})
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+			"backup-"+time.Now().UTC().Format("20060102T150405Z")+".tar.gz"))
+
+		if err := s.Backup(w); err != nil {
+			// the archive is truncated, which restoring it detects.
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"pypibot/auth"
+	"pypibot/rpc"
+	"pypibot/store"
+)
+
+// userResp is a user as sent by the api. Its id, which is hex encoded, hides
+// that of the embedded user.
+type userResp struct {
+	*store.User
+	Id     string `json:"id"`
+	Online bool   `json:"online"`
+}
+
+// userReq is the body of POST and PATCH requests. Fields that are omitted
+// are left unchanged by PATCH.
+type userReq struct {
+	Email   *string `json:"email"`
+	Name    *string `json:"name"`
+	Type    *string `json:"type"`
+	KeyType string  `json:"key-type"`
+}
+
+func newUserResp(srv *rpc.Server, id []byte, user *store.User) *userResp {
+	return &userResp{
+		User:   user,
+		Id:     hex.EncodeToString(id),
+		Online: srv.IsOnline(id),
+	}
+}
+
+func parseUserType(name string) (store.User_UserType, error) {
+	t, ok := store.User_UserType_value[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("invalid user type: %s", name)
+	}
+	return store.User_UserType(t), nil
+}
+
+// userOf finds the user named by the request's path, which ends with the hex
+// encoding of the user's id. It writes an error response and returns a nil
+// user if there is none.
+func userOf(s *store.Store, w http.ResponseWriter, r *http.Request) ([]byte, *store.User) {
+	id, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/api/v1/users/"))
+	if err != nil {
+		writeError(w, "invalid id", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	user, err := s.FindUser(id)
+	if err == store.ErrNoUser {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return nil, nil
+	} else if err != nil {
+		writeInternalError(w, err)
+		return nil, nil
+	}
+
+	return id, user
+}
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+var errPageFull = errors.New("page is full")
+
+// userFilter selects the users listed by listUsers.
+type userFilter struct {
+	t     *store.User_UserType
+	email string
+	name  string
+}
+
+func parseUserFilter(q url.Values) (*userFilter, error) {
+	f := &userFilter{
+		email: strings.ToLower(q.Get("email")),
+		name:  strings.ToLower(q.Get("name")),
+	}
+
+	if v := q.Get("type"); v != "" {
+		t, err := parseUserType(v)
+		if err != nil {
+			return nil, err
+		}
+		f.t = &t
+	}
+
+	return f, nil
+}
+
+// matches reports whether the user is of the filter's type and has an email
+// and name containing the filter's, ignoring case.
+func (f *userFilter) matches(user *store.User) bool {
+	return (f.t == nil || user.Type == *f.t) &&
+		strings.Contains(strings.ToLower(user.Email), f.email) &&
+		strings.Contains(strings.ToLower(user.Name), f.name)
+}
+
+// listUsers responds with a page of users in order of email. The query may
+// contain:
+//
+//	limit  the number of users per page, at most 1000
+//	after  the email of the last user of the previous page
+//	order  asc or desc
+//	type   PERSON, BOT or GOD
+//	email  a substring of the email
+//	name   a substring of the name
+//
+// If there are more users, the Link header points to the next page.
+func listUsers(s *store.Store, srv *rpc.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		limit := defaultPageSize
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxPageSize {
+				writeError(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		var reverse bool
+		switch q.Get("order") {
+		case "", "asc":
+		case "desc":
+			reverse = true
+		default:
+			writeError(w, "invalid order", http.StatusBadRequest)
+			return
+		}
+
+		filter, err := parseUserFilter(q)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		users := []*userResp{}
+		more := false
+
+		if err := s.ForEachUserByEmail(q.Get("after"), reverse, func(id []byte, user *store.User) error {
+			if !filter.matches(user) {
+				return nil
+			}
+
+			if len(users) == limit {
+				more = true
+				return errPageFull
+			}
+
+			users = append(users, newUserResp(srv, append([]byte{}, id...), proto.Clone(user).(*store.User)))
+			return nil
+		}); err != nil && err != errPageFull {
+			writeInternalError(w, err)
+			return
+		}
+
+		if more {
+			q.Set("after", users[len(users)-1].Email)
+			w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, q.Encode()))
+		}
+
+		writeJson(w, users, http.StatusOK)
+	}
+}
+
+// getUser responds with a single user. Users other than admins may only look
+// themselves up.
+func getUser(s *store.Store, srv *rpc.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, user := userOf(s, w, r)
+		if user == nil {
+			return
+		}
+
+		c := callerOf(r)
+		if c.user.Type != store.User_GOD && !bytes.Equal(c.id, id) {
+			writeError(w, "permission denied", http.StatusForbidden)
+			return
+		}
+
+		writeJson(w, newUserResp(srv, id, user), http.StatusOK)
+	}
+}
+
+// createUser creates a user along with a key and responds with the user's
+// cert and key as a PEM bundle.
+func createUser(s *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the response holds the new user's private key.
+		if !requireTLS(w, r) {
+			return
+		}
+
+		var req userReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Email == nil || *req.Email == "" || req.Name == nil {
+			writeError(w, "email and name are required", http.StatusBadRequest)
+			return
+		}
+
+		t := store.User_PERSON
+		if req.Type != nil {
+			var err error
+			if t, err = parseUserType(*req.Type); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		kt, err := s.Config.KeyType()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		if req.KeyType != "" {
+			if kt, err = auth.ParseKeyType(req.KeyType); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		user, crtPem, keyPem, err := s.CreateUserWithKeyType(*req.Email, *req.Name, t, kt)
+		if err == store.ErrEmailInUse {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		var b bytes.Buffer
+		pem.Encode(&b, crtPem)
+		pem.Encode(&b, keyPem)
+
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=%q", user.Email+".pem"))
+		w.Header().Set("Location", "/api/v1/users/"+hex.EncodeToString(user.Id))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b.Bytes())
+	}
+}
+
+func updateUser(s *store.Store, srv *rpc.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, user := userOf(s, w, r)
+		if user == nil {
+			return
+		}
+
+		var req userReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		t := user.Type
+		if req.Type != nil {
+			var err error
+			if t, err = parseUserType(*req.Type); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if req.Email != nil && *req.Email == "" {
+			writeError(w, "email is required", http.StatusBadRequest)
+			return
+		}
+
+		user, err := s.UpdateUser(id, func(u *store.User) error {
+			if req.Email != nil {
+				u.Email = *req.Email
+			}
+			if req.Name != nil {
+				u.Name = *req.Name
+			}
+			u.Type = t
+			return nil
+		})
+		if err == store.ErrEmailInUse {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		writeJson(w, newUserResp(srv, id, user), http.StatusOK)
+	}
+}
+
+// deleteUser revokes the user. The record is kept, as with all revocations,
+// so that the user's history remains available. The reason may be given in
+// the reason query parameter.
+func deleteUser(s *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, user := userOf(s, w, r)
+		if user == nil {
+			return
+		}
+
+		if user.IsRevoked() {
+			writeError(w, "user is already revoked", http.StatusConflict)
+			return
+		}
+
+		if err := s.RevokeUser(id, r.URL.Query().Get("reason")); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
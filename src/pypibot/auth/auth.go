@@ -1,16 +1,19 @@
 package auth
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -21,13 +24,15 @@ const (
 	expiresAfter    = 1000 * 24 * time.Hour
 )
 
-func GenerateServerCert(bits int, host string) (*pem.Block, *pem.Block, error) {
-	prv, err := rsa.GenerateKey(rand.Reader, bits)
+// GenerateCACert creates a new key pair and a self-signed CA certificate that
+// is used to sign both the server's certificate and all client certificates.
+func GenerateCACert(t KeyType) (*pem.Block, *pem.Block, error) {
+	prv, err := GenerateKey(t)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	sn, err := newSerialNumber()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -37,10 +42,8 @@ func GenerateServerCert(bits int, host string) (*pem.Block, *pem.Block, error) {
 		NotAfter:              time.Now().Add(expiresAfter),
 		SerialNumber:          sn,
 		BasicConstraintsValid: true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		KeyUsage:              x509.KeyUsageDataEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		IsCA:                  true,
-		DNSNames:              []string{host},
 		Subject: pkix.Name{
 			Country:            []string{certInfoCountry},
 			Organization:       []string{certInfoOrgName},
@@ -48,7 +51,7 @@ func GenerateServerCert(bits int, host string) (*pem.Block, *pem.Block, error) {
 		},
 	}
 
-	crt, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &prv.PublicKey, prv)
+	crt, err := x509.CreateCertificate(rand.Reader, tpl, tpl, prv.Public(), prv)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -56,34 +59,135 @@ func GenerateServerCert(bits int, host string) (*pem.Block, *pem.Block, error) {
 	return toPems(crt, prv)
 }
 
-func GenerateClientCert(bits int, caCrtPem, caKeyPem *pem.Block) (*pem.Block, *pem.Block, error) {
-	prv, err := rsa.GenerateKey(rand.Reader, bits)
+// GenerateServerCert creates a new key pair and a certificate for the server
+// that is signed by the given CA and is valid for the given names and
+// addresses.
+func GenerateServerCert(t KeyType, caCrtPem, caKeyPem *pem.Block, dnsNames []string, ips []net.IP) (*pem.Block, *pem.Block, error) {
+	prv, err := GenerateKey(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sn, err := newSerialNumber()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	caCrt, caKey, err := parseCA(caCrtPem, caKeyPem)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	tpl := &x509.Certificate{
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(expiresAfter),
+		SerialNumber:          sn,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              leafKeyUsage(prv.Public()),
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+		Subject: pkix.Name{
+			Country:            []string{certInfoCountry},
+			Organization:       []string{certInfoOrgName},
+			OrganizationalUnit: []string{certInfoOrgUnit},
+		},
+	}
+
+	crt, err := x509.CreateCertificate(rand.Reader, tpl, caCrt, prv.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return toPems(crt, prv)
+}
+
+// CrossSignCACert creates a certificate with the same subject and key as the
+// CA in crtPem, but signed by the CA in caCrtPem. Peers that only trust the
+// CA in caCrtPem can use it as an intermediate to verify certs issued by
+// the CA in crtPem.
+func CrossSignCACert(crtPem, caCrtPem, caKeyPem *pem.Block) (*pem.Block, error) {
+	tpl, err := x509.ParseCertificate(crtPem.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	caCrt, caKey, err := parseCA(caCrtPem, caKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	sn, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	tpl.SerialNumber = sn
+
+	crt, err := x509.CreateCertificate(rand.Reader, tpl, caCrt, tpl.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: crt,
+	}, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func parseCA(caCrtPem, caKeyPem *pem.Block) (*x509.Certificate, crypto.Signer, error) {
 	caCrt, err := x509.ParseCertificate(caCrtPem.Bytes)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	caKey, err := x509.ParsePKCS1PrivateKey(caKeyPem.Bytes)
+	caKey, err := ParsePrivateKey(caKeyPem)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return caCrt, caKey, nil
+}
+
+// GenerateClientCert creates a new key pair and a certificate for it that is
+// signed by the given CA and is valid for the duration validFor.
+func GenerateClientCert(t KeyType, caCrtPem, caKeyPem *pem.Block, validFor time.Duration) (*pem.Block, *pem.Block, error) {
+	prv, err := GenerateKey(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crt, err := IssueClientCert(prv.Public(), caCrtPem, caKeyPem, validFor)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return toPems(crt.Bytes, prv)
+}
+
+// IssueClientCert creates a certificate for an existing public key that is
+// signed by the given CA and is valid for the duration validFor.
+func IssueClientCert(pub crypto.PublicKey, caCrtPem, caKeyPem *pem.Block, validFor time.Duration) (*pem.Block, error) {
+	sn, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	caCrt, caKey, err := parseCA(caCrtPem, caKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
 	tpl := &x509.Certificate{
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(expiresAfter),
+		NotAfter:              time.Now().Add(validFor),
 		SerialNumber:          sn,
 		BasicConstraintsValid: true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              leafKeyUsage(pub),
 		Subject: pkix.Name{
 			Country:            []string{certInfoCountry},
 			Organization:       []string{certInfoOrgName},
@@ -91,47 +195,136 @@ func GenerateClientCert(bits int, caCrtPem, caKeyPem *pem.Block) (*pem.Block, *p
 		},
 	}
 
-	crt, err := x509.CreateCertificate(rand.Reader, tpl, caCrt, &prv.PublicKey, caKey)
+	crt, err := x509.CreateCertificate(rand.Reader, tpl, caCrt, pub, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: crt,
+	}, nil
+}
+
+// GenerateCSR creates a new key pair and a certificate signing request for
+// it. The private key never needs to leave the machine that generated it.
+func GenerateCSR(t KeyType) (*pem.Block, *pem.Block, error) {
+	prv, err := GenerateKey(t)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return toPems(crt, prv)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			Country:            []string{certInfoCountry},
+			Organization:       []string{certInfoOrgName},
+			OrganizationalUnit: []string{certInfoOrgUnit},
+		},
+	}, prv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPem, err := keyToPem(prv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csr,
+	}, keyPem, nil
+}
+
+// SignCSR verifies the certificate signing request and issues a client
+// certificate for its public key that is signed by the given CA.
+func SignCSR(csrPem *pem.Block, caCrtPem, caKeyPem *pem.Block, validFor time.Duration) (*pem.Block, error) {
+	if csrPem.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("invalid pem type for csr: %s", csrPem.Type)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrPem.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	return IssueClientCert(csr.PublicKey, caCrtPem, caKeyPem, validFor)
+}
+
+// Fingerprint returns the SHA-256 digest of the DER encoded certificate.
+func Fingerprint(crtPem *pem.Block) []byte {
+	h := sha256.Sum256(crtPem.Bytes)
+	return h[:]
 }
 
-func toPems(crt []byte, key *rsa.PrivateKey) (*pem.Block, *pem.Block, error) {
+func toPems(crt []byte, key crypto.Signer) (*pem.Block, *pem.Block, error) {
+	keyPem, err := keyToPem(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	return &pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: crt,
-		}, &pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		}, nil
+		Type:  "CERTIFICATE",
+		Bytes: crt,
+	}, keyPem, nil
 }
 
-func writePem(b *pem.Block, filename string) error {
-	w, err := os.Create(filename)
+// WritePem writes the pem block to filename.
+func WritePem(b *pem.Block, filename string) error {
+	return writeFileAtomic(filename, 0644, func(w io.Writer) error {
+		return pem.Encode(w, b)
+	})
+}
+
+// writeFileAtomic writes a file with the given mode by way of a temporary
+// file in the same directory that is renamed into place, so that the file is
+// never left partly written.
+func writeFileAtomic(filename string, mode os.FileMode, write func(io.Writer) error) error {
+	w, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	defer os.Remove(w.Name())
+
+	if err := w.Chmod(mode); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := write(w); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
 
-	return pem.Encode(w, b)
+	return os.Rename(w.Name(), filename)
 }
 
 func WriteBothPems(crt *pem.Block, crtFile string, key *pem.Block, keyFile string) error {
-	if err := writePem(crt, crtFile); err != nil {
+	if err := WritePem(crt, crtFile); err != nil {
 		return err
 	}
 
-	if err := writePem(key, keyFile); err != nil {
+	if err := WritePem(key, keyFile); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func ReadPem(filename string) (*pem.Block, error) {
+func readRawPem(filename string) (*pem.Block, error) {
 	c, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -145,48 +338,59 @@ func ReadPem(filename string) (*pem.Block, error) {
 	return b, nil
 }
 
-func ReadBothPems(crtFile, keyFile string) (*pem.Block, *pem.Block, error) {
-	crt, err := ReadPem(crtFile)
+// ReadPem reads the first pem block in filename. Encrypted keys are decrypted
+// with the passphrase set by SetPassphrase.
+func ReadPem(filename string) (*pem.Block, error) {
+	b, err := readRawPem(filename)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	key, err := ReadPem(keyFile)
+	if !IsEncrypted(b) {
+		return b, nil
+	}
+
+	d, err := decryptKeyPem(b)
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("%s: %s", filename, err)
 	}
 
-	return crt, key, nil
+	return d, nil
 }
 
-func parsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
-	x, err := x509.ParsePKCS1PrivateKey(b)
-	if err == nil {
-		return x, nil
+// IsEncryptedFile returns true if the pem in filename is an encrypted key.
+func IsEncryptedFile(filename string) (bool, error) {
+	b, err := readRawPem(filename)
+	if err != nil {
+		return false, err
+	}
+
+	return IsEncrypted(b), nil
+}
+
+func ReadBothPems(crtFile, keyFile string) (*pem.Block, *pem.Block, error) {
+	crt, err := ReadPem(crtFile)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	y, err := x509.ParsePKCS8PrivateKey(b)
-	if err == nil {
-		return y.(*rsa.PrivateKey), nil
+	key, err := ReadPem(keyFile)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil, errors.New("unable to decode private key")
+	return crt, key, nil
 }
 
-func ReadPrivateKey(filename string) (*rsa.PrivateKey, error) {
-	b, err := ioutil.ReadFile(filename)
+func ReadPrivateKey(filename string) (crypto.Signer, error) {
+	p, err := ReadPem(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	p, _ := pem.Decode(b)
-	if p == nil {
-		return nil, fmt.Errorf("invalid pem: %s", filename)
-	}
-
-	return parsePrivateKey(p.Bytes)
+	return ParsePrivateKey(p)
 }
 
-func GetPublicKey(prv *rsa.PrivateKey) ([]byte, error) {
-	return x509.MarshalPKIXPublicKey(&prv.PublicKey)
+func GetPublicKey(prv crypto.Signer) ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(prv.Public())
 }
@@ -1,12 +1,18 @@
 package auth
 
 import (
+	"bytes"
 	"crypto/x509"
 	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-const keyBits = 2048
+const keyType = RSA
 
 func assertValidCrtAndKey(t *testing.T, crtPem, keyPem *pem.Block) {
 	if crtPem.Type != "CERTIFICATE" {
@@ -18,36 +24,452 @@ func assertValidCrtAndKey(t *testing.T, crtPem, keyPem *pem.Block) {
 		t.Fatal(err)
 	}
 
-	if keyPem.Type != "RSA PRIVATE KEY" {
-		t.Fatalf("Expected pem type of RSA PRIVATE KEY, got %s", keyPem.Type)
+	if keyPem.Type != "RSA PRIVATE KEY" && keyPem.Type != "PRIVATE KEY" {
+		t.Fatalf("Expected pem type of RSA PRIVATE KEY or PRIVATE KEY, got %s", keyPem.Type)
 	}
 
-	_, err = x509.ParsePKCS1PrivateKey(keyPem.Bytes)
+	_, err = ParsePrivateKey(keyPem)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestGenerateCACert(t *testing.T) {
+	crtPem, keyPem, err := GenerateCACert(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertValidCrtAndKey(t, crtPem, keyPem)
+}
+
 func TestGenerateServerCert(t *testing.T) {
-	crtPem, keyPem, err := GenerateServerCert(keyBits, "kellegous")
+	caCrtPem, caKeyPem, err := GenerateCACert(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crtPem, keyPem, err := GenerateServerCert(
+		keyType,
+		caCrtPem,
+		caKeyPem,
+		[]string{"kellegous"},
+		[]net.IP{net.ParseIP("127.0.0.1")})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	assertValidCrtAndKey(t, crtPem, keyPem)
+
+	crt, err := x509.ParseCertificate(crtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCrt, err := x509.ParseCertificate(caCrtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := x509.NewCertPool()
+	p.AddCert(caCrt)
+
+	for _, name := range []string{"kellegous", "127.0.0.1"} {
+		if _, err := crt.Verify(x509.VerifyOptions{
+			DNSName: name,
+			Roots:   p,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCrossSignCACert(t *testing.T) {
+	oldCrtPem, oldKeyPem, err := GenerateCACert(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCrtPem, newKeyPem, err := GenerateCACert(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crossPem, err := CrossSignCACert(newCrtPem, oldCrtPem, oldKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crtPem, _, err := GenerateServerCert(keyType, newCrtPem, newKeyPem, []string{"kellegous"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, caPem := range []*pem.Block{oldCrtPem, newCrtPem} {
+		ca, err := x509.ParseCertificate(caPem.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cross, err := x509.ParseCertificate(crossPem.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crt, err := x509.ParseCertificate(crtPem.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+
+		inters := x509.NewCertPool()
+		inters.AddCert(cross)
+
+		if _, err := crt.Verify(x509.VerifyOptions{
+			DNSName:       "kellegous",
+			Roots:         roots,
+			Intermediates: inters,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
 }
 
 func TestGenerateClientCert(t *testing.T) {
-	caCrtPem, caKeyPem, err := GenerateServerCert(keyBits, "kellegous")
+	caCrtPem, caKeyPem, err := GenerateCACert(keyType)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	crtPem, keyPem, err := GenerateClientCert(keyBits, caCrtPem, caKeyPem)
+	crtPem, keyPem, err := GenerateClientCert(keyType, caCrtPem, caKeyPem, time.Hour)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// TODO(knorton): Assert that client is signed by server.
 	assertValidCrtAndKey(t, crtPem, keyPem)
+
+	crt, err := x509.ParseCertificate(crtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCrt, err := x509.ParseCertificate(caCrtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := crt.CheckSignatureFrom(caCrt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignCSR(t *testing.T) {
+	caCrtPem, caKeyPem, err := GenerateCACert(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrPem, keyPem, err := GenerateCSR(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crtPem, err := SignCSR(csrPem, caCrtPem, caKeyPem, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertValidCrtAndKey(t, crtPem, keyPem)
+
+	prv, err := x509.ParsePKCS1PrivateKey(keyPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := x509.ParseCertificate(crtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !prv.PublicKey.Equal(crt.PublicKey) {
+		t.Fatal("expected cert to be issued for the key in the csr")
+	}
+
+	if _, err := SignCSR(keyPem, caCrtPem, caKeyPem, time.Hour); err == nil {
+		t.Fatal("expected an error signing something other than a csr")
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	for _, kt := range []KeyType{RSA, ECDSA, Ed25519} {
+		pt, err := ParseKeyType(kt.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pt != kt {
+			t.Fatalf("expected %s, got %s", kt, pt)
+		}
+
+		caCrtPem, caKeyPem, err := GenerateCACert(kt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertValidCrtAndKey(t, caCrtPem, caKeyPem)
+
+		crtPem, keyPem, err := GenerateClientCert(kt, caCrtPem, caKeyPem, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertValidCrtAndKey(t, crtPem, keyPem)
+
+		if (kt == RSA) != (keyPem.Type == "RSA PRIVATE KEY") {
+			t.Fatalf("unexpected pem type for %s key: %s", kt, keyPem.Type)
+		}
+
+		prv, err := ParsePrivateKey(keyPem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crt, err := x509.ParseCertificate(crtPem.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pub, err := GetPublicKey(prv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(pub) != string(crt.RawSubjectPublicKeyInfo) {
+			t.Fatalf("cert does not match %s key", kt)
+		}
+
+		csrPem, _, err := GenerateCSR(kt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := SignCSR(csrPem, caCrtPem, caKeyPem, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ParseKeyType("dsa"); err == nil {
+		t.Fatal("expected an error for an unknown key type")
+	}
+}
+
+func TestEncryptPem(t *testing.T) {
+	_, keyPem, err := GenerateCACert(ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encPem, err := EncryptPem(keyPem, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsEncrypted(encPem) || IsEncrypted(keyPem) {
+		t.Fatal("expected only the encrypted pem to be encrypted")
+	}
+
+	// the block must survive encoding as a file would.
+	encPem, _ = pem.Decode(pem.EncodeToMemory(encPem))
+	if encPem == nil {
+		t.Fatal("unable to decode encrypted pem")
+	}
+
+	if _, err := DecryptPem(encPem, []byte("hunter3")); err != ErrBadPassphrase {
+		t.Fatalf("expected ErrBadPassphrase, got %v", err)
+	}
+
+	decPem, err := DecryptPem(encPem, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decPem.Type != keyPem.Type || string(decPem.Bytes) != string(keyPem.Bytes) {
+		t.Fatal("decrypted pem does not match the original")
+	}
+
+	// the content type is authenticated.
+	encPem.Headers["Content-Type"] = "RSA PRIVATE KEY"
+	if _, err := DecryptPem(encPem, []byte("hunter2")); err != ErrBadPassphrase {
+		t.Fatalf("expected ErrBadPassphrase, got %v", err)
+	}
+	encPem.Headers["Content-Type"] = keyPem.Type
+
+	encPem.Headers["Kdf-Params"] = "N=1073741824,r=8,p=1"
+	if _, err := DecryptPem(encPem, []byte("hunter2")); err == nil {
+		t.Fatal("expected an error for excessive kdf params")
+	}
+
+	if _, err := EncryptPem(keyPem, nil); err == nil {
+		t.Fatal("expected an error for an empty passphrase")
+	}
+}
+
+func TestReadEncryptedPem(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	_, keyPem, err := GenerateCACert(Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pf := filepath.Join(tmp, "passphrase")
+	if err := ioutil.WriteFile(pf, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ParsePassphrase("file:"+pf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(tmp, "key.pem")
+	if err := WriteKeyPem(keyPem, keyFile, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if enc, err := IsEncryptedFile(keyFile); err != nil {
+		t.Fatal(err)
+	} else if !enc {
+		t.Fatal("expected the key file to be encrypted")
+	}
+
+	os.Setenv("TEST_PASSPHRASE", "hunter2")
+	defer os.Unsetenv("TEST_PASSPHRASE")
+
+	p, err = ParsePassphrase("env:TEST_PASSPHRASE", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetPassphrase(p)
+	defer SetPassphrase(nil)
+
+	if _, err := ReadPrivateKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	SetPassphrase(PassphraseFromEnv("TEST_NO_PASSPHRASE"))
+	if _, err := ReadPem(keyFile); err == nil {
+		t.Fatal("expected an error without a passphrase")
+	}
+
+	if _, err := ParsePassphrase("hunter2", false); err == nil {
+		t.Fatal("expected an error for an invalid passphrase source")
+	}
+}
+
+func TestWrongPassphraseNotKept(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	_, keyPem, err := GenerateCACert(Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(tmp, "key.pem")
+	if err := WriteKeyPem(keyPem, keyFile, func() ([]byte, error) {
+		return []byte("hunter2"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	answers := []string{"hunter3", "hunter2"}
+	calls := 0
+	SetPassphrase(func() ([]byte, error) {
+		calls++
+		if calls > len(answers) {
+			t.Fatal("passphrase asked for after it decrypted a key")
+		}
+		return []byte(answers[calls-1]), nil
+	})
+	defer SetPassphrase(nil)
+
+	if _, err := ReadPem(keyFile); err == nil {
+		t.Fatal("expected the wrong passphrase to be rejected")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := ReadPem(keyFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if p, err := KeyPassphrase(); err != nil {
+		t.Fatal(err)
+	} else if string(p) != "hunter2" {
+		t.Fatalf("expected the passphrase that decrypted the key, got %q", p)
+	}
+}
+
+func TestWritePemReplaces(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	crtPem, keyPem, err := GenerateCACert(Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crtFile := filepath.Join(tmp, "crt.pem")
+	keyFile := filepath.Join(tmp, "key.pem")
+
+	for i := 0; i < 2; i++ {
+		if err := WritePem(crtPem, crtFile); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := WriteKeyPem(keyPem, keyFile, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, mode := range map[string]os.FileMode{
+		crtFile: 0644,
+		keyFile: 0600,
+	} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != mode {
+			t.Fatalf("%s: expected mode %v, got %v", file, mode, fi.Mode().Perm())
+		}
+	}
+
+	// the temporary files are renamed into place.
+	if files, err := ioutil.ReadDir(tmp); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	if b, err := ReadPem(keyFile); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b.Bytes, keyPem.Bytes) {
+		t.Fatal("expected the key to be written")
+	}
 }
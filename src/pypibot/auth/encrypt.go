@@ -0,0 +1,403 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// An encrypted key is a PEM block of type encryptedPemType whose bytes are
+// the bytes of the original block sealed with AES-256-GCM. The AES key is
+// derived from a passphrase with scrypt. The headers, in any order, hold
+// everything needed to decrypt it:
+//
+//	-----BEGIN PYPIBOT ENCRYPTED KEY-----
+//	Cipher: AES-256-GCM
+//	Content-Type: <type of the original block, e.g. PRIVATE KEY>
+//	Kdf: scrypt
+//	Kdf-Params: N=32768,r=8,p=1
+//	Kdf-Salt: <hex, 16 bytes>
+//	Nonce: <hex, 12 bytes>
+//
+//	<base64 ciphertext and tag>
+//	-----END PYPIBOT ENCRYPTED KEY-----
+//
+// The content type is authenticated as additional data so that a key cannot
+// be decrypted as a block of another type.
+const (
+	encryptedPemType = "PYPIBOT ENCRYPTED KEY"
+
+	kdfScrypt = "scrypt"
+	cipherGcm = "AES-256-GCM"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	// limits on the parameters accepted when decrypting, so that a crafted
+	// file cannot exhaust memory.
+	maxScryptN = 1 << 20
+	maxScryptR = 32
+	maxScryptP = 16
+
+	saltSize = 16
+	aesSize  = 32
+)
+
+// PassphraseEnv and PassphraseFileEnv name the environment variables that
+// hold the passphrase of encrypted keys, or the name of a file containing
+// it, when no other source is given.
+const (
+	PassphraseEnv     = "PYPIBOT_PASSPHRASE"
+	PassphraseFileEnv = "PYPIBOT_PASSPHRASE_FILE"
+)
+
+// ErrBadPassphrase is returned when an encrypted key cannot be decrypted
+// with the passphrase it is given, or has been tampered with.
+var ErrBadPassphrase = errors.New("incorrect passphrase or corrupt key")
+
+// IsEncrypted returns true if b is a key encrypted by EncryptPem.
+func IsEncrypted(b *pem.Block) bool {
+	return b.Type == encryptedPemType
+}
+
+func deriveKey(passphrase, salt []byte, n, r, p int) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return scrypt.Key(passphrase, salt, n, r, p, aesSize)
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+// EncryptPem seals the block b, usually a private key, with a key derived
+// from passphrase.
+func EncryptPem(b *pem.Block, passphrase []byte) (*pem.Block, error) {
+	if IsEncrypted(b) {
+		return nil, errors.New("pem is already encrypted")
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type: encryptedPemType,
+		Headers: map[string]string{
+			"Kdf":          kdfScrypt,
+			"Kdf-Params":   fmt.Sprintf("N=%d,r=%d,p=%d", scryptN, scryptR, scryptP),
+			"Kdf-Salt":     hex.EncodeToString(salt),
+			"Cipher":       cipherGcm,
+			"Nonce":        hex.EncodeToString(nonce),
+			"Content-Type": b.Type,
+		},
+		Bytes: gcm.Seal(nil, nonce, b.Bytes, []byte(b.Type)),
+	}, nil
+}
+
+// DecryptPem opens a block sealed by EncryptPem with passphrase.
+func DecryptPem(b *pem.Block, passphrase []byte) (*pem.Block, error) {
+	if !IsEncrypted(b) {
+		return nil, fmt.Errorf("pem is not encrypted: %s", b.Type)
+	}
+
+	if k := b.Headers["Kdf"]; k != kdfScrypt {
+		return nil, fmt.Errorf("unsupported kdf: %q", k)
+	}
+
+	if c := b.Headers["Cipher"]; c != cipherGcm {
+		return nil, fmt.Errorf("unsupported cipher: %q", c)
+	}
+
+	var n, r, p int
+	if _, err := fmt.Sscanf(b.Headers["Kdf-Params"], "N=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return nil, fmt.Errorf("invalid kdf params: %s", err)
+	}
+
+	if n <= 1 || n > maxScryptN || n&(n-1) != 0 || r <= 0 || r > maxScryptR || p <= 0 || p > maxScryptP {
+		return nil, fmt.Errorf("unsupported kdf params: %s", b.Headers["Kdf-Params"])
+	}
+
+	salt, err := hex.DecodeString(b.Headers["Kdf-Salt"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("invalid kdf salt")
+	}
+
+	typ := b.Headers["Content-Type"]
+	if typ == "" {
+		return nil, errors.New("encrypted pem has no content type")
+	}
+
+	key, err := deriveKey(passphrase, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(b.Headers["Nonce"])
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+
+	plain, err := gcm.Open(nil, nonce, b.Bytes, []byte(typ))
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	return &pem.Block{
+		Type:  typ,
+		Bytes: plain,
+	}, nil
+}
+
+// Passphrase returns the passphrase with which keys are encrypted.
+type Passphrase func() ([]byte, error)
+
+// PassphraseFromEnv reads the passphrase from the environment variable name.
+func PassphraseFromEnv(name string) Passphrase {
+	return func() ([]byte, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return nil, fmt.Errorf("%s is not set", name)
+		}
+		return []byte(v), nil
+	}
+}
+
+// PassphraseFromFile reads the passphrase from the first line of filename.
+func PassphraseFromFile(filename string) Passphrase {
+	return func() ([]byte, error) {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if i := bytes.IndexAny(b, "\r\n"); i >= 0 {
+			b = b[:i]
+		}
+
+		if len(b) == 0 {
+			return nil, fmt.Errorf("%s is empty", filename)
+		}
+		return b, nil
+	}
+}
+
+// PassphrasePrompt asks for the passphrase on the terminal, without echoing
+// it. With confirm, it is asked for twice and the answers must match, as is
+// wise when encrypting.
+func PassphrasePrompt(prompt string, confirm bool) Passphrase {
+	return func() ([]byte, error) {
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return nil, errors.New("a passphrase is required but stdin is not a terminal")
+		}
+
+		read := func(prompt string) ([]byte, error) {
+			fmt.Fprintf(os.Stderr, "%s: ", prompt)
+			defer fmt.Fprintln(os.Stderr)
+			return term.ReadPassword(fd)
+		}
+
+		p, err := read(prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		if confirm {
+			c, err := read("Confirm " + strings.ToLower(prompt[:1]) + prompt[1:])
+			if err != nil {
+				return nil, err
+			}
+
+			if !bytes.Equal(p, c) {
+				return nil, errors.New("passphrases do not match")
+			}
+		}
+
+		if len(p) == 0 {
+			return nil, errors.New("empty passphrase")
+		}
+		return p, nil
+	}
+}
+
+// CachePassphrase returns a Passphrase that calls p until it succeeds and
+// then returns that passphrase, so that it is asked for at most once. It is
+// meant for encrypting, where a prompt confirms the passphrase; the
+// passphrase with which keys are decrypted is only kept once it works, see
+// SetPassphrase.
+func CachePassphrase(p Passphrase) Passphrase {
+	var lck sync.Mutex
+	var v []byte
+	return func() ([]byte, error) {
+		lck.Lock()
+		defer lck.Unlock()
+
+		if v != nil {
+			return v, nil
+		}
+
+		b, err := p()
+		if err != nil {
+			return nil, err
+		}
+		v = b
+		return v, nil
+	}
+}
+
+// ParsePassphrase returns the passphrase source described by spec, which is
+// one of:
+//
+//	env:NAME   the environment variable NAME
+//	file:PATH  the first line of the file PATH
+//	prompt     asked for on the terminal
+//
+// The source is read each time it is called. With confirm, a prompt asks for
+// the passphrase twice.
+func ParsePassphrase(spec string, confirm bool) (Passphrase, error) {
+	switch {
+	case strings.HasPrefix(spec, "env:"):
+		return PassphraseFromEnv(spec[len("env:"):]), nil
+	case strings.HasPrefix(spec, "file:"):
+		return PassphraseFromFile(spec[len("file:"):]), nil
+	case spec == "prompt":
+		return PassphrasePrompt("Passphrase", confirm), nil
+	}
+	return nil, fmt.Errorf("invalid passphrase source: %q", spec)
+}
+
+// defaultPassphrase is read from PassphraseEnv, or else from the file named
+// by PassphraseFileEnv, or else asked for on the terminal.
+func defaultPassphrase() ([]byte, error) {
+	if _, ok := os.LookupEnv(PassphraseEnv); ok {
+		return PassphraseFromEnv(PassphraseEnv)()
+	}
+
+	if f := os.Getenv(PassphraseFileEnv); f != "" {
+		return PassphraseFromFile(f)()
+	}
+
+	return PassphrasePrompt("Passphrase for encrypted keys", false)()
+}
+
+// keyPassphrase holds the source of the passphrase with which ReadPem
+// decrypts keys and, once it has decrypted one, the passphrase itself. A
+// passphrase that fails is not kept, so a mistyped one is asked for again.
+var keyPassphrase = struct {
+	sync.Mutex
+	p Passphrase
+	v []byte
+}{p: defaultPassphrase}
+
+// SetPassphrase sets the source of the passphrase with which ReadPem decrypts
+// encrypted keys. By default it is read from PassphraseEnv or the file
+// named by PassphraseFileEnv, or asked for on the terminal, and a nil p
+// restores that default. Either way it is only obtained once an encrypted
+// key is read, and kept once it has decrypted one.
+func SetPassphrase(p Passphrase) {
+	if p == nil {
+		p = defaultPassphrase
+	}
+
+	keyPassphrase.Lock()
+	defer keyPassphrase.Unlock()
+
+	keyPassphrase.p = p
+	keyPassphrase.v = nil
+}
+
+// KeyPassphrase returns the passphrase with which ReadPem decrypts keys: the
+// one that decrypted a key, or else one obtained from the source set by
+// SetPassphrase.
+func KeyPassphrase() ([]byte, error) {
+	keyPassphrase.Lock()
+	defer keyPassphrase.Unlock()
+
+	if keyPassphrase.v != nil {
+		return keyPassphrase.v, nil
+	}
+	return keyPassphrase.p()
+}
+
+// decryptKeyPem decrypts b with KeyPassphrase and keeps the passphrase if it
+// succeeds.
+func decryptKeyPem(b *pem.Block) (*pem.Block, error) {
+	keyPassphrase.Lock()
+	defer keyPassphrase.Unlock()
+
+	passphrase := keyPassphrase.v
+	if passphrase == nil {
+		var err error
+		if passphrase, err = keyPassphrase.p(); err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := DecryptPem(b, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPassphrase.v = passphrase
+	return d, nil
+}
+
+// WriteKeyPem writes the key to filename so that it is only readable by its
+// owner. If p is not nil, the key is first encrypted with its passphrase.
+func WriteKeyPem(b *pem.Block, filename string, p Passphrase) error {
+	if p != nil {
+		passphrase, err := p()
+		if err != nil {
+			return err
+		}
+
+		if b, err = EncryptPem(b, passphrase); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(filename, 0600, func(w io.Writer) error {
+		return pem.Encode(w, b)
+	})
+}
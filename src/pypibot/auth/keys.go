@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const bitsInRsaKeys = 2048
+
+// KeyType is the algorithm of a generated key pair.
+type KeyType int
+
+const (
+	// RSA keys are 2048 bits.
+	RSA KeyType = iota
+
+	// ECDSA keys use the P-256 curve.
+	ECDSA
+
+	// Ed25519 ...
+	Ed25519
+)
+
+var keyTypeNames = map[KeyType]string{
+	RSA:     "rsa",
+	ECDSA:   "ecdsa",
+	Ed25519: "ed25519",
+}
+
+func (t KeyType) String() string {
+	if n, ok := keyTypeNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("KeyType(%d)", int(t))
+}
+
+// ParseKeyType converts the name of a key algorithm (rsa, ecdsa or ed25519)
+// into a KeyType.
+func ParseKeyType(s string) (KeyType, error) {
+	for t, n := range keyTypeNames {
+		if strings.EqualFold(n, s) {
+			return t, nil
+		}
+	}
+	return RSA, fmt.Errorf("invalid key type: %s", s)
+}
+
+// GenerateKey creates a new private key of the given type.
+func GenerateKey(t KeyType) (crypto.Signer, error) {
+	switch t {
+	case RSA:
+		return rsa.GenerateKey(rand.Reader, bitsInRsaKeys)
+	case ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, prv, err := ed25519.GenerateKey(rand.Reader)
+		return prv, err
+	}
+	return nil, fmt.Errorf("invalid key type: %s", t)
+}
+
+// keyToPem encodes RSA keys as PKCS#1 for compatibility with existing key
+// files and all other keys as PKCS#8.
+func keyToPem(key crypto.Signer) (*pem.Block, error) {
+	if k, ok := key.(*rsa.PrivateKey); ok {
+		return &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}, nil
+	}
+
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: b,
+	}, nil
+}
+
+// ParsePrivateKey decodes an RSA, ECDSA or Ed25519 private key that is
+// encoded as PKCS#1, SEC 1 or PKCS#8.
+func ParsePrivateKey(keyPem *pem.Block) (crypto.Signer, error) {
+	if k, err := x509.ParsePKCS1PrivateKey(keyPem.Bytes); err == nil {
+		return k, nil
+	}
+
+	if k, err := x509.ParseECPrivateKey(keyPem.Bytes); err == nil {
+		return k, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(keyPem.Bytes)
+	if err != nil {
+		return nil, errors.New("unable to decode private key")
+	}
+
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("unsupported private key: %T", k)
+}
+
+// leafKeyUsage returns the key usage for certs that are not CAs. Only RSA
+// keys can be used for key encipherment.
+func leafKeyUsage(pub crypto.PublicKey) x509.KeyUsage {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
@@ -0,0 +1,63 @@
+package authz
+
+import (
+	"errors"
+
+	"pypibot/store"
+)
+
+// ErrDenied is returned when a user is not permitted to perform an
+// operation.
+var ErrDenied = errors.New("permission denied")
+
+// Policy lists the user types that are permitted to perform an operation.
+// GOD users are only permitted what their policy lists, so device operations
+// can be kept to bots.
+type Policy []store.User_UserType
+
+var (
+	// Anyone permits every type of user.
+	Anyone = Policy{store.User_PERSON, store.User_BOT, store.User_GOD}
+
+	// Admins permits only GOD users and is meant for administrative
+	// operations.
+	Admins = Policy{store.User_GOD}
+
+	// Bots permits only BOT users and is meant for device operations.
+	Bots = Policy{store.User_BOT}
+)
+
+// Permits indicates whether user may perform an operation under the policy.
+// Revoked users are permitted nothing.
+func (p Policy) Permits(user *store.User) bool {
+	if user == nil || user.IsRevoked() {
+		return false
+	}
+
+	for _, t := range p {
+		if user.Type == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Privileged indicates whether the policy permits only GOD users, which makes
+// the operations under it administrative.
+func (p Policy) Privileged() bool {
+	for _, t := range p {
+		if t != store.User_GOD {
+			return false
+		}
+	}
+	return len(p) > 0
+}
+
+// Check returns ErrDenied if the policy does not permit user.
+func (p Policy) Check(user *store.User) error {
+	if !p.Permits(user) {
+		return ErrDenied
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package authz
+
+import (
+	"testing"
+
+	"pypibot/store"
+)
+
+func TestPolicies(t *testing.T) {
+	person := &store.User{Type: store.User_PERSON}
+	bot := &store.User{Type: store.User_BOT}
+	god := &store.User{Type: store.User_GOD}
+	revoked := &store.User{
+		Type:       store.User_GOD,
+		Revocation: &store.Revocation{},
+	}
+
+	for _, test := range []struct {
+		name   string
+		policy Policy
+		user   *store.User
+		ok     bool
+	}{
+		{"anyone/person", Anyone, person, true},
+		{"anyone/bot", Anyone, bot, true},
+		{"anyone/god", Anyone, god, true},
+		{"anyone/revoked", Anyone, revoked, false},
+		{"anyone/nobody", Anyone, nil, false},
+		{"admins/person", Admins, person, false},
+		{"admins/bot", Admins, bot, false},
+		{"admins/god", Admins, god, true},
+		{"admins/revoked", Admins, revoked, false},
+		{"bots/person", Bots, person, false},
+		{"bots/bot", Bots, bot, true},
+		{"bots/god", Bots, god, false},
+	} {
+		if ok := test.policy.Permits(test.user); ok != test.ok {
+			t.Fatalf("%s: expected %t, got %t", test.name, test.ok, ok)
+		}
+
+		if err := test.policy.Check(test.user); (err == nil) != test.ok {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestPrivileged(t *testing.T) {
+	if !Admins.Privileged() {
+		t.Fatal("expected admin operations to be privileged")
+	}
+
+	for _, p := range []Policy{Anyone, Bots, nil} {
+		if p.Privileged() {
+			t.Fatalf("expected %v not to be privileged", p)
+		}
+	}
+}
@@ -1,35 +1,290 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"pypibot/auth"
 	"pypibot/rpc"
 )
 
+// enrollClient returns the client with which to enroll at url, which must use
+// https so that the token is not sent in the clear. The server's cert is
+// issued by its own CA, so it is verified with a copy of the CA in caFile if
+// one was distributed with the token, or else with the CA whose fingerprint,
+// fp, was given out of band.
+func enrollClient(rawurl, caFile string, fp []byte) (*http.Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "https" {
+		return nil, errors.New("enrolling requires an https url")
+	}
+
+	if caPem, err := auth.ReadPem(caFile); err == nil {
+		caCrt, err := x509.ParseCertificate(caPem.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		p := x509.NewCertPool()
+		p.AddCert(caCrt)
+
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: p,
+				},
+			},
+		}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// without either, the server is verified with the system's roots,
+	// which only works if its cert is from a public CA.
+	if fp == nil {
+		return http.DefaultClient, nil
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// the chain is verified against the CA with the
+				// fingerprint instead, see verifyFingerprint.
+				InsecureSkipVerify: true,
+				VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+					return verifyFingerprint(rawCerts, u.Hostname(), fp)
+				},
+			},
+		},
+	}, nil
+}
+
+// verifyFingerprint checks that the server's cert, the first of rawCerts, is
+// valid for host and issued by a CA in the chain whose fingerprint is fp.
+func verifyFingerprint(rawCerts [][]byte, host string, fp []byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		crt, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = crt
+	}
+
+	for _, crt := range certs[1:] {
+		if !bytes.Equal(auth.Fingerprint(&pem.Block{Bytes: crt.Raw}), fp) {
+			continue
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(crt)
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName: host,
+			Roots:   roots,
+		})
+		return err
+	}
+
+	return errors.New("server's chain lacks the CA with the given fingerprint")
+}
+
+// enroll generates a new key locally and exchanges a certificate signing
+// request for it, along with a one-time token, for a cert signed by the
+// server's CA. The server is verified as described by enrollClient. The key
+// is encrypted with p if it is not nil. Nothing is written unless enrollment
+// succeeds, and then each file is replaced whole.
+func enroll(url, token string, kt auth.KeyType, crtFile, keyFile, caFile string, fp []byte, p auth.Passphrase) error {
+	c, err := enrollClient(url, caFile, fp)
+	if err != nil {
+		return err
+	}
+
+	csrPem, keyPem, err := auth.GenerateCSR(kt)
+	if err != nil {
+		return err
+	}
+
+	// ask for the passphrase before the token is used up.
+	if p != nil {
+		passphrase, err := p()
+		if err != nil {
+			return err
+		}
+
+		if keyPem, err = auth.EncryptPem(keyPem, passphrase); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"token": token,
+		"csr":   string(pem.EncodeToMemory(csrPem)),
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Post(url+"/api/v1/enroll", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("enroll failed: %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	var data struct {
+		Crt string `json:"crt"`
+		Ca  string `json:"ca"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return err
+	}
+
+	crtPem, _ := pem.Decode([]byte(data.Crt))
+	caPem, _ := pem.Decode([]byte(data.Ca))
+	if crtPem == nil || caPem == nil {
+		return errors.New("invalid enroll response")
+	}
+
+	if fp != nil && !bytes.Equal(auth.Fingerprint(caPem), fp) {
+		return errors.New("server's CA does not match the given fingerprint")
+	}
+
+	// the key is already encrypted, if it is to be.
+	if err := auth.WriteKeyPem(keyPem, keyFile, nil); err != nil {
+		return err
+	}
+
+	if err := auth.WritePem(crtPem, crtFile); err != nil {
+		return err
+	}
+
+	return auth.WritePem(caPem, caFile)
+}
+
 func main() {
 	flagCrt := flag.String("crt", "crt.pem", "")
 	flagKey := flag.String("key", "key.pem", "")
-	flagSrvCrt := flag.String("srvCrt", "data/srv.crt.pem", "")
+	flagCACrt := flag.String("caCrt", "data/ca.crt.pem", "")
+	flagAddr := flag.String("addr", "pypi.kellego.us:8081", "")
+	flagRenew := flag.Bool("renew", false, "")
+	flagEnroll := flag.String("enroll", "", "")
+	flagToken := flag.String("token", "", "")
+	flagCAFingerprint := flag.String("caFingerprint", "", "")
+	flagKeyType := flag.String("keyType", "rsa", "")
+	flagPassphrase := flag.String("passphrase", "", "")
+	flagEncrypt := flag.String("encrypt", "", "")
 	flag.Parse()
 
+	// an encrypted key is decrypted with the passphrase from -passphrase,
+	// which is one of env:NAME, file:PATH or prompt, or by default from
+	// PYPIBOT_PASSPHRASE, the file named by PYPIBOT_PASSPHRASE_FILE or a
+	// prompt.
+	if *flagPassphrase != "" {
+		p, err := auth.ParsePassphrase(*flagPassphrase, false)
+		if err != nil {
+			log.Panic(err)
+		}
+		auth.SetPassphrase(p)
+	}
+
+	// as with the server, -encrypt gives the source of the passphrase with
+	// which new keys are encrypted. It is obtained right away so that a
+	// mistyped one fails before the token or the old key is used up.
+	var p auth.Passphrase
+	if *flagEncrypt != "" {
+		var err error
+		if p, err = auth.ParsePassphrase(*flagEncrypt, true); err != nil {
+			log.Panic(err)
+		}
+		p = auth.CachePassphrase(p)
+
+		if _, err := p(); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if *flagEnroll != "" {
+		kt, err := auth.ParseKeyType(*flagKeyType)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		var fp []byte
+		if *flagCAFingerprint != "" {
+			if fp, err = hex.DecodeString(strings.Replace(*flagCAFingerprint, ":", "", -1)); err != nil {
+				log.Panic(err)
+			}
+		}
+
+		if err := enroll(*flagEnroll, *flagToken, kt, *flagCrt, *flagKey, *flagCACrt, fp, p); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+
 	crtPem, keyPem, err := auth.ReadBothPems(*flagCrt, *flagKey)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	srvCrtPem, err := auth.ReadPem(*flagSrvCrt)
+	caCrtPem, err := auth.ReadPem(*flagCACrt)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	clt, err := rpc.Dial("pypi.kellego.us:8081", srvCrtPem, crtPem, keyPem)
+	clt, err := rpc.Dial(*flagAddr, caCrtPem, crtPem, keyPem)
 	if err != nil {
 		log.Panic(err)
 	}
 
+	if *flagRenew {
+		// without -encrypt, a renewed key stays encrypted if the one it
+		// replaces was.
+		if enc, err := auth.IsEncryptedFile(*flagKey); err != nil {
+			log.Panic(err)
+		} else if enc && p == nil {
+			p = auth.KeyPassphrase
+		}
+
+		crtPem, keyPem, err := clt.Renew()
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if err := auth.WritePem(crtPem, *flagCrt); err != nil {
+			log.Panic(err)
+		}
+
+		if err := auth.WriteKeyPem(keyPem, *flagKey, p); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+
 	for {
 		res, err := clt.Ping()
 		if err != nil {
@@ -0,0 +1,370 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/.
+//
+// Every metric may have labels. Values for the labels are given to With,
+// which returns the child for that combination, creating it if need be.
+// Metrics without labels are used through the child for no values.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default is the registry that the metrics of this program are added to and
+// that Handler serves.
+var Default = NewRegistry()
+
+// Registry is a set of metrics with distinct names.
+type Registry struct {
+	lck     sync.Mutex
+	metrics map[string]*family
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: map[string]*family{},
+	}
+}
+
+// child is the value of a metric for one combination of label values.
+type child interface {
+	write(w *bufio.Writer, name, labels string)
+}
+
+// family is a metric and its children.
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	newChild func() child
+
+	lck      sync.Mutex
+	children map[string]child
+	values   map[string][]string
+}
+
+func (f *family) with(values []string) child {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values",
+			f.name, len(f.labels), len(values)))
+	}
+
+	k := strings.Join(values, "\xff")
+
+	f.lck.Lock()
+	defer f.lck.Unlock()
+
+	c, ok := f.children[k]
+	if !ok {
+		c = f.newChild()
+		f.children[k] = c
+		f.values[k] = append([]string{}, values...)
+	}
+	return c
+}
+
+func (r *Registry) add(name, help, typ string, labels []string, newChild func() child) *family {
+	f := &family{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		newChild: newChild,
+		children: map[string]child{},
+		values:   map[string][]string{},
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %s", name))
+	}
+	r.metrics[name] = f
+	return f
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// formatLabels renders names and values as the label set of a sample, with
+// extra appended as is.
+func formatLabels(names, values []string, extra string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, n, labelEscaper.Replace(values[i])))
+	}
+
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes every metric in the registry to w, ordered by name and then
+// by label values so that the output is stable.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lck.Lock()
+	families := make([]*family, 0, len(r.metrics))
+	for _, f := range r.metrics {
+		families = append(families, f)
+	}
+	r.lck.Unlock()
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	for _, f := range families {
+		f.lck.Lock()
+		keys := make([]string, 0, len(f.children))
+		for k := range f.children {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, k := range keys {
+			f.children[k].write(bw, f.name, formatLabels(f.labels, f.values[k], ""))
+		}
+		f.lck.Unlock()
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Handler serves the metrics in the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Handler serves the metrics in Default.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Counter is a count that only goes up.
+type Counter struct {
+	v uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the count.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w *bufio.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, labels, c.Value())
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct {
+	f *family
+}
+
+// NewCounter adds a counter to the registry.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.add(name, help, "counter", labels, func() child {
+		return &Counter{}
+	})}
+}
+
+// With returns the counter for the label values.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.with(values).(*Counter)
+}
+
+// Gauge is a value that may go up and down.
+type Gauge struct {
+	v int64
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+// Value returns the gauge's value.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) write(w *bufio.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, labels, g.Value())
+}
+
+// GaugeVec is a gauge with labels.
+type GaugeVec struct {
+	f *family
+}
+
+// NewGauge adds a gauge to the registry.
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.add(name, help, "gauge", labels, func() child {
+		return &Gauge{}
+	})}
+}
+
+// With returns the gauge for the label values.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.with(values).(*Gauge)
+}
+
+// Histogram counts observations in buckets by their upper bounds.
+type Histogram struct {
+	bounds []float64
+
+	lck    sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe records the value v.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveSince records the seconds elapsed since t.
+func (h *Histogram) ObserveSince(t time.Time) {
+	h.Observe(time.Since(t).Seconds())
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w *bufio.Writer, name, labels string) {
+	h.lck.Lock()
+	counts := append([]uint64{}, h.counts...)
+	count, sum := h.count, h.sum
+	h.lck.Unlock()
+
+	// le is added to the sample's own labels.
+	bucket := func(le string) string {
+		if labels == "" {
+			return "{" + le + "}"
+		}
+		return labels[:len(labels)-1] + "," + le + "}"
+	}
+
+	var n uint64
+	for i, b := range h.bounds {
+		n += counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucket(`le="`+formatValue(b)+`"`), n)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucket(`le="+Inf"`), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatValue(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct {
+	f *family
+}
+
+// NewHistogram adds a histogram with the given bucket bounds, which must be
+// in increasing order, to the registry.
+func (r *Registry) NewHistogram(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(bounds) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+
+	return &HistogramVec{r.add(name, help, "histogram", labels, func() child {
+		return &Histogram{
+			bounds: bounds,
+			counts: make([]uint64, len(bounds)),
+		}
+	})}
+}
+
+// With returns the histogram for the label values.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.with(values).(*Histogram)
+}
+
+// LatencyBuckets are bounds, in seconds, suited to the latency of requests
+// and storage operations.
+var LatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+// SizeBuckets are bounds, in bytes, suited to the size of messages.
+var SizeBuckets = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
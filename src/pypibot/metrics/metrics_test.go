@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	accepts := r.NewCounter("test_accepts_total", "Connections accepted.")
+	requests := r.NewCounter("test_requests_total", "Requests by type.", "type")
+	sessions := r.NewGauge("test_sessions", "Live sessions.", "type")
+	latency := r.NewHistogram("test_latency_seconds", "Latency.\nIn seconds.", []float64{.1, 1}, "op")
+
+	accepts.With().Inc()
+	requests.With("b").Add(3)
+	requests.With("a").Inc()
+	requests.With("quote\"d\\").Inc()
+	sessions.With("BOT").Inc()
+	sessions.With("BOT").Inc()
+	sessions.With("BOT").Dec()
+	latency.With("get").Observe(.05)
+	latency.With("get").Observe(.1)
+	latency.With("get").Observe(.5)
+	latency.With("get").Observe(2)
+
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_accepts_total Connections accepted.
+# TYPE test_accepts_total counter
+test_accepts_total 1
+# HELP test_latency_seconds Latency.\nIn seconds.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="get",le="0.1"} 2
+test_latency_seconds_bucket{op="get",le="1"} 3
+test_latency_seconds_bucket{op="get",le="+Inf"} 4
+test_latency_seconds_sum{op="get"} 2.65
+test_latency_seconds_count{op="get"} 4
+# HELP test_requests_total Requests by type.
+# TYPE test_requests_total counter
+test_requests_total{type="a"} 1
+test_requests_total{type="b"} 3
+test_requests_total{type="quote\"d\\"} 1
+# HELP test_sessions Live sessions.
+# TYPE test_sessions gauge
+test_sessions{type="BOT"} 1
+`
+
+	if b.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewHistogram("test_seconds", "Unlabeled.", LatencyBuckets).With().Observe(.002)
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+
+	body, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`test_seconds_bucket{le="0.001"} 0`,
+		`test_seconds_bucket{le="0.005"} 1`,
+		`test_seconds_bucket{le="+Inf"} 1`,
+		`test_seconds_count 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatalf("expected %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "", "a", "b")
+
+	for _, f := range []func(){
+		func() { r.NewGauge("test_total", "") },
+		func() { c.With("a") },
+		func() { r.NewHistogram("test_seconds", "", []float64{1, .1}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected a panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
@@ -4,13 +4,38 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
 
-	"pypibot/store"
+	"github.com/golang/protobuf/proto"
+
+	"pypibot/auth"
 )
 
-// Client ...
+// maxResponseSize is the largest frame body the client accepts from the
+// server.
+const maxResponseSize = 1 << 24
+
+type response struct {
+	t uint32
+	b []byte
+}
+
+// Client is a connection to the server. Its methods are safe to call from
+// multiple goroutines and calls made concurrently share the connection.
 type Client struct {
 	c *tls.Conn
+
+	wlck sync.Mutex
+
+	lck      sync.Mutex
+	nextId   uint32
+	pending  map[uint32]chan *response
+	handlers map[string]*pushHandler
+	err      error
 }
 
 // Close ...
@@ -18,27 +43,172 @@ func (c *Client) Close() error {
 	return c.c.Close()
 }
 
-// Ping ...
-func (c *Client) Ping() (*PingRes, error) {
-	var id int32 = 1
+// read delivers each response to the call that is waiting for it and each
+// push to its handler until the connection fails.
+func (c *Client) read() {
+	for {
+		t, id, b, err := readMsg(c.c, maxResponseSize)
+		if err != nil {
+			c.fail(err)
+			return
+		}
 
-	if err := writeMsg(c.c, msgPingMsg, &PingReq{
-		Id: id,
-	}); err != nil {
-		return nil, err
+		if t == msgPushMsg && id&pushFlag != 0 {
+			go c.handlePush(id, b)
+			continue
+		}
+
+		c.lck.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.lck.Unlock()
+
+		if ch == nil {
+			log.Printf("rpc: dropping message %d with unknown id %d", t, id)
+			continue
+		}
+
+		ch <- &response{
+			t: t,
+			b: b,
+		}
+	}
+}
+
+// fail causes all pending and future calls to return err.
+func (c *Client) fail(err error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// Call sends req to the server and waits for the response, which is
+// unmarshaled into res. The type of the request is derived from req, see
+// MsgType, so it must match the type a handler was registered for on the
+// server. If the server rejects the request, the error is an *Error.
+func (c *Client) Call(req, res proto.Message) error {
+	return c.call(MsgType(req), req, res)
+}
+
+func (c *Client) call(t uint32, req, res proto.Message) error {
+	c.lck.Lock()
+	if c.err != nil {
+		c.lck.Unlock()
+		return c.err
+	}
+
+	c.nextId = (c.nextId + 1) &^ pushFlag
+	if c.nextId == 0 {
+		c.nextId++
+	}
+	id := c.nextId
+
+	ch := make(chan *response, 1)
+	c.pending[id] = ch
+	c.lck.Unlock()
+
+	c.wlck.Lock()
+	err := writeMsg(c.c, t, id, req)
+	c.wlck.Unlock()
+
+	if err != nil {
+		c.lck.Lock()
+		delete(c.pending, id)
+		c.lck.Unlock()
+		return err
+	}
+
+	r, ok := <-ch
+	if !ok {
+		c.lck.Lock()
+		defer c.lck.Unlock()
+		return c.err
+	}
+
+	if r.t == msgErrorMsg {
+		var m ErrorRes
+		if err := proto.Unmarshal(r.b, &m); err != nil {
+			return err
+		}
+		return fromErrorRes(&m)
+	}
+
+	if r.t != t {
+		return fmt.Errorf("wrong type: expected %d, got %d", t, r.t)
 	}
 
+	return proto.Unmarshal(r.b, res)
+}
+
+// Ping ...
+func (c *Client) Ping() (*PingRes, error) {
 	var res PingRes
-	if err := readAndUnmarshalMsg(c.c, msgPingMsg, &res); err != nil {
+	if err := c.Call(&PingReq{
+		Id: 1,
+	}, &res); err != nil {
 		return nil, err
 	}
 
 	return &res, nil
 }
 
-// Dial ...
-func Dial(addr string, srvCrtPem, crtPem, keyPem *pem.Block) (*Client, error) {
-	prv, err := x509.ParsePKCS1PrivateKey(keyPem.Bytes)
+// Renew asks the server to issue a new cert and key pair for the connected
+// user. The current cert continues to work until the server's grace period
+// has elapsed.
+func (c *Client) Renew() (*pem.Block, *pem.Block, error) {
+	var res RenewRes
+	if err := c.Call(&RenewReq{}, &res); err != nil {
+		return nil, nil, err
+	}
+
+	crtPem, _ := pem.Decode(res.Crt)
+	if crtPem == nil {
+		return nil, nil, errors.New("invalid cert in renew response")
+	}
+
+	keyPem, _ := pem.Decode(res.Key)
+	if keyPem == nil {
+		return nil, nil, errors.New("invalid key in renew response")
+	}
+
+	return crtPem, keyPem, nil
+}
+
+// Revoke revokes the user with the given id. It is only permitted for GOD
+// users.
+func (c *Client) Revoke(id []byte, reason string) error {
+	return c.Call(&RevokeReq{
+		Id:     id,
+		Reason: reason,
+	}, &RevokeRes{})
+}
+
+// ReportStatus sets the status shown with the connected bot's session. It is
+// only permitted for BOT users.
+func (c *Client) ReportStatus(status string) error {
+	return c.Call(&StatusReq{
+		Status: status,
+	}, &StatusRes{})
+}
+
+// Dial connects to the server at addr, verifying the server's cert against
+// the CA in caCrtPem.
+func Dial(addr string, caCrtPem, crtPem, keyPem *pem.Block) (*Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if host == "" {
+		host = "localhost"
+	}
+
+	prv, err := auth.ParsePrivateKey(keyPem)
 	if err != nil {
 		return nil, err
 	}
@@ -48,7 +218,7 @@ func Dial(addr string, srvCrtPem, crtPem, keyPem *pem.Block) (*Client, error) {
 		PrivateKey:  prv,
 	}
 
-	caCrt, err := x509.ParseCertificate(srvCrtPem.Bytes)
+	caCrt, err := x509.ParseCertificate(caCrtPem.Bytes)
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +229,7 @@ func Dial(addr string, srvCrtPem, crtPem, keyPem *pem.Block) (*Client, error) {
 	cfg := &tls.Config{
 		Certificates: []tls.Certificate{crt},
 		RootCAs:      p,
-		ServerName:   store.ServerName,
+		ServerName:   host,
 	}
 
 	con, err := tls.Dial("tcp", addr, cfg)
@@ -67,7 +237,12 @@ func Dial(addr string, srvCrtPem, crtPem, keyPem *pem.Block) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{
-		c: con,
-	}, nil
+	c := &Client{
+		c:        con,
+		pending:  map[uint32]chan *response{},
+		handlers: map[string]*pushHandler{},
+	}
+	go c.read()
+
+	return c, nil
 }
@@ -1,31 +1,207 @@
 package rpc
 
 import (
+	"context"
+	"encoding/pem"
 	"fmt"
-	"net"
+	"hash/fnv"
+	"log"
+	"reflect"
+	"sync"
 
 	"github.com/golang/protobuf/proto"
+
+	"pypibot/authz"
+	"pypibot/store"
+)
+
+// msgPushMsg is the type of push frames and their acknowledgments and
+// msgErrorMsg is the type of error frames sent in place of a response. The
+// types of requests are derived from the names of their messages by MsgType.
+const (
+	msgPushMsg uint32 = iota
+	msgErrorMsg
+)
+
+// Handler handles a request of type Req from an authenticated user and
+// returns the response. The context carries the store and the user's id, see
+// StoreOf and UidOf, and is canceled when the connection closes.
+type Handler[Req, Res proto.Message] func(ctx context.Context, user *store.User, req Req) (Res, error)
+
+type handler struct {
+	name   string
+	req    reflect.Type
+	policy authz.Policy
+	h      func(ctx context.Context, user *store.User, req proto.Message) (proto.Message, error)
+}
+
+var (
+	handlersLck sync.RWMutex
+	handlers    = map[uint32]*handler{}
+
+	// builtins registers the handlers of this package. It cannot run from
+	// an init function since the message types are only registered by the
+	// generated code's own init.
+	builtins sync.Once
 )
 
+type ctxKey int
+
 const (
-	msgPingMsg uint32 = iota
+	storeKey ctxKey = iota
+	uidKey
+	connKey
 )
 
-func cmdPing(c net.Conn, b []byte) error {
-	var m PingReq
-	if err := proto.Unmarshal(b, &m); err != nil {
-		return err
+// StoreOf returns the store of the server handling the request.
+func StoreOf(ctx context.Context) *store.Store {
+	return ctx.Value(storeKey).(*store.Store)
+}
+
+// UidOf returns the id of the user that made the request.
+func UidOf(ctx context.Context) []byte {
+	return ctx.Value(uidKey).([]byte)
+}
+
+func connOf(ctx context.Context) *conn {
+	return ctx.Value(connKey).(*conn)
+}
+
+// MsgType returns the frame type of requests of the same type as m, which is
+// the FNV-1a hash of the message's fully qualified name.
+func MsgType(m proto.Message) uint32 {
+	return msgTypeOf(proto.MessageName(m))
+}
+
+func msgTypeOf(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+// Register adds a handler for requests of type Req, which responds with
+// messages of type Res and is only called for users permitted by policy. Req
+// must be a pointer to a generated message. Register panics if a handler
+// already exists for the request's type, so it is meant to be called from init
+// functions.
+func Register[Req, Res proto.Message](policy authz.Policy, h Handler[Req, Res]) {
+	builtins.Do(registerBuiltins)
+	register(policy, h)
+}
+
+func register[Req, Res proto.Message](policy authz.Policy, h Handler[Req, Res]) {
+	rt := reflect.TypeOf((*Req)(nil)).Elem()
+	if rt.Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("rpc: %s is not a pointer to a message", rt))
+	}
+
+	req := reflect.New(rt.Elem()).Interface().(proto.Message)
+	t := MsgType(req)
+	if t == msgPushMsg || t == msgErrorMsg {
+		panic(fmt.Sprintf("rpc: %s has a reserved type", proto.MessageName(req)))
+	}
+
+	handlersLck.Lock()
+	defer handlersLck.Unlock()
+
+	if _, ok := handlers[t]; ok {
+		panic(fmt.Sprintf("rpc: duplicate handler for %s", proto.MessageName(req)))
 	}
-	return writeMsg(c, msgPingMsg, &PingRes{
-		Id: m.Id,
-	})
+
+	handlers[t] = &handler{
+		name:   proto.MessageName(req),
+		req:    rt.Elem(),
+		policy: policy,
+		h: func(ctx context.Context, user *store.User, req proto.Message) (proto.Message, error) {
+			res, err := h(ctx, user, req.(Req))
+			if err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	}
+}
+
+func registerBuiltins() {
+	register(authz.Anyone, cmdPing)
+	register(authz.Anyone, cmdRenew)
+	register(authz.Admins, cmdRevoke)
+	register(authz.Bots, cmdStatus)
+}
+
+func cmdPing(ctx context.Context, user *store.User, req *PingReq) (*PingRes, error) {
+	return &PingRes{
+		Id: req.Id,
+	}, nil
+}
+
+func cmdRenew(ctx context.Context, user *store.User, req *RenewReq) (*RenewRes, error) {
+	_, crtPem, keyPem, err := StoreOf(ctx).RotateUserKey(UidOf(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return &RenewRes{
+		Crt: pem.EncodeToMemory(crtPem),
+		Key: pem.EncodeToMemory(keyPem),
+	}, nil
 }
 
-func dispatch(c net.Conn, t uint32, b []byte) error {
-	switch t {
-	case msgPingMsg:
-		return cmdPing(c, b)
-	default:
-		return fmt.Errorf("invalid message: %d", t)
+func cmdRevoke(ctx context.Context, user *store.User, req *RevokeReq) (*RevokeRes, error) {
+	if err := StoreOf(ctx).RevokeUser(req.Id, req.Reason); err != nil {
+		return nil, Errorf(ErrorCode_BAD_REQUEST, "%s", err)
 	}
+	return &RevokeRes{}, nil
+}
+
+func cmdStatus(ctx context.Context, user *store.User, req *StatusReq) (*StatusRes, error) {
+	connOf(ctx).setStatus(req.Status)
+	return &StatusRes{}, nil
+}
+
+// auditCall records a privileged request, or an attempt at one, in the audit
+// log.
+func auditCall(ctx context.Context, c *conn, detail string) {
+	if err := StoreOf(ctx).Audit(&store.AuditEntry{
+		Event:      store.AuditRpc,
+		Actor:      c.uid,
+		RemoteAddr: c.c.RemoteAddr().String(),
+		Detail:     detail,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// dispatch handles a request of type t from the user the connection was
+// authenticated as and returns the response.
+func dispatch(ctx context.Context, c *conn, t uint32, b []byte) (proto.Message, error) {
+	builtins.Do(registerBuiltins)
+
+	handlersLck.RLock()
+	h := handlers[t]
+	handlersLck.RUnlock()
+
+	if h == nil {
+		return nil, Errorf(ErrorCode_INVALID_TYPE, "invalid message: %d", t)
+	}
+
+	if !h.policy.Permits(c.user) {
+		err := Errorf(ErrorCode_PERMISSION_DENIED, "%s may not send %s",
+			c.user.Email, h.req.Name())
+		if h.policy.Privileged() {
+			auditCall(ctx, c, err.Error())
+		}
+		return nil, err
+	}
+
+	req := reflect.New(h.req).Interface().(proto.Message)
+	if err := proto.Unmarshal(b, req); err != nil {
+		return nil, Errorf(ErrorCode_BAD_REQUEST, "invalid %s: %s", proto.MessageName(req), err)
+	}
+
+	if h.policy.Privileged() {
+		auditCall(ctx, c, fmt.Sprintf("%s %s", proto.MessageName(req), proto.CompactTextString(req)))
+	}
+
+	return h.h(ctx, c.user, req)
 }
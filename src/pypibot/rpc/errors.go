@@ -0,0 +1,59 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error is a failed request. Handlers may return an *Error to control the
+// code the caller sees; any other error is reported as INTERNAL. Client
+// methods return an *Error when the server rejected the request.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details []string
+}
+
+// Errorf returns an *Error with the given code and a formatted message.
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("rpc: %s: %s", e.Code, e.Message)
+	if len(e.Details) > 0 {
+		msg += " (" + strings.Join(e.Details, "; ") + ")"
+	}
+	return msg
+}
+
+// internalErrorMessage is all that callers are told of INTERNAL errors, whose
+// detail may reveal the server's internals. The detail is logged instead.
+const internalErrorMessage = "internal error"
+
+// toErrorRes converts an error returned by a handler into an error frame.
+func toErrorRes(err error) *ErrorRes {
+	if e, ok := err.(*Error); ok && e.Code != ErrorCode_INTERNAL {
+		return &ErrorRes{
+			Code:    e.Code,
+			Message: e.Message,
+			Details: e.Details,
+		}
+	}
+
+	return &ErrorRes{
+		Code:    ErrorCode_INTERNAL,
+		Message: internalErrorMessage,
+	}
+}
+
+func fromErrorRes(m *ErrorRes) *Error {
+	return &Error{
+		Code:    m.Code,
+		Message: m.Message,
+		Details: m.Details,
+	}
+}
@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const fuzzMaxFrameSize = 1 << 16
+
+func frame(t, id uint32, m proto.Message) []byte {
+	var buf bytes.Buffer
+	if err := writeMsg(&buf, t, id, m); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// fuzzConn is a connection whose reads come from a fixed buffer and never
+// time out.
+type fuzzConn struct {
+	*bytes.Reader
+}
+
+func (fuzzConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// FuzzReadFrame feeds arbitrary bytes to readFrame, as serve does, and
+// unmarshals any frame it returns into each registered request type, as
+// dispatch does. The seed corpus is in testdata/fuzz/FuzzReadFrame.
+func FuzzReadFrame(f *testing.F) {
+	f.Add(frame(MsgType(&PingReq{}), 1, &PingReq{Id: 7}))
+	f.Add(frame(MsgType(&RenewReq{}), 2, &RenewReq{}))
+	f.Add(frame(msgPushMsg, 3|pushFlag, &PushAck{Error: "no handler"}))
+
+	builtins.Do(registerBuiltins)
+
+	s := &Server{
+		maxFrameSize: fuzzMaxFrameSize,
+		frameSizes: map[uint32]uint32{
+			MsgType(&PingReq{}): 64,
+		},
+		readTimeout: time.Second,
+		idleTimeout: time.Second,
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := fuzzConn{bytes.NewReader(b)}
+		for {
+			typ, _, m, err := s.readFrame(c)
+			if err != nil {
+				return
+			}
+
+			if max := s.frameSize(typ); uint32(len(m)) > max {
+				t.Fatalf("read a body of %d bytes for message %d, over %d", len(m), typ, max)
+			}
+
+			handlersLck.RLock()
+			for _, h := range handlers {
+				req := reflect.New(h.req).Interface().(proto.Message)
+				proto.Unmarshal(m, req)
+			}
+			handlersLck.RUnlock()
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"pypibot/metrics"
+	"pypibot/store"
+)
+
+var (
+	metricAccepts = metrics.Default.NewCounter(
+		"pypibot_rpc_accepts_total",
+		"Connections accepted by the rpc server.").With()
+
+	metricHandshakeFailures = metrics.Default.NewCounter(
+		"pypibot_rpc_handshake_failures_total",
+		"Connections whose TLS handshake failed.").With()
+
+	metricAuthFailures = metrics.Default.NewCounter(
+		"pypibot_rpc_auth_failures_total",
+		"Connections whose client cert did not identify a valid user.").With()
+
+	metricRequests = metrics.Default.NewCounter(
+		"pypibot_rpc_requests_total",
+		"Requests dispatched, by message and the code of the error, if any.",
+		"message", "code")
+
+	metricRequestDuration = metrics.Default.NewHistogram(
+		"pypibot_rpc_request_duration_seconds",
+		"Time taken to dispatch requests, by message.",
+		metrics.LatencyBuckets,
+		"message")
+
+	metricFrameBytes = metrics.Default.NewHistogram(
+		"pypibot_rpc_frame_bytes",
+		"Size of frame bodies read and written by the server.",
+		metrics.SizeBuckets,
+		"direction")
+
+	metricSessions = metrics.Default.NewGauge(
+		"pypibot_rpc_sessions",
+		"Live sessions, by the type of their user.",
+		"type")
+)
+
+// metricMessageName returns the label for requests of type t. Only types
+// with handlers are named so that peers cannot create labels at will.
+func metricMessageName(t uint32) string {
+	handlersLck.RLock()
+	defer handlersLck.RUnlock()
+
+	if h, ok := handlers[t]; ok {
+		return h.name
+	}
+	return "unknown"
+}
+
+// metricCode returns the label for the outcome of a request.
+func metricCode(err error) string {
+	if err == nil {
+		return "OK"
+	}
+	return toErrorRes(err).Code.String()
+}
+
+// metricSessionsOf returns the gauge of live sessions of users of the same
+// type as user.
+func metricSessionsOf(user *store.User) *metrics.Gauge {
+	return metricSessions.With(user.Type.String())
+}
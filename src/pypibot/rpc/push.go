@@ -0,0 +1,164 @@
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// pushFlag is set on the request ids of pushes, which are allocated by the
+// server, so that they never collide with ids allocated by the client.
+const pushFlag uint32 = 1 << 31
+
+// pushTimeout is how long the server waits for a client to acknowledge a
+// push.
+const pushTimeout = 10 * time.Second
+
+// ErrNotConnected is returned by Push when the user has no live connections.
+var ErrNotConnected = errors.New("user is not connected")
+
+// push sends m to the client and waits for it to be acknowledged.
+func (c *conn) push(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	c.lck.Lock()
+	c.nextPushId = (c.nextPushId + 1) &^ pushFlag
+	id := c.nextPushId | pushFlag
+	ch := make(chan *PushAck, 1)
+	c.pushes[id] = ch
+	c.lck.Unlock()
+
+	defer func() {
+		c.lck.Lock()
+		delete(c.pushes, id)
+		c.lck.Unlock()
+	}()
+
+	if err := c.write(msgPushMsg, id, &Push{
+		Type: proto.MessageName(m),
+		Body: b,
+	}); err != nil {
+		return err
+	}
+
+	select {
+	case ack := <-ch:
+		if ack.Error != "" {
+			return errors.New(ack.Error)
+		}
+		return nil
+	case <-time.After(pushTimeout):
+		return errors.New("push was not acknowledged")
+	}
+}
+
+// ack delivers an acknowledgment from the client to the waiting push.
+func (c *conn) ack(id uint32, b []byte) error {
+	var ack PushAck
+	if err := proto.Unmarshal(b, &ack); err != nil {
+		return err
+	}
+
+	// the entry is removed so that a client repeating the acknowledgment
+	// cannot block the connection's reader on a channel no one reads.
+	c.lck.Lock()
+	ch := c.pushes[id]
+	delete(c.pushes, id)
+	c.lck.Unlock()
+
+	if ch != nil {
+		select {
+		case ch <- &ack:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Push sends m to every live connection of the user identified by uid and
+// waits for each client to acknowledge it. ErrNotConnected is returned if the
+// user has no live connections.
+func (s *Server) Push(uid []byte, m proto.Message) error {
+	var conns []*conn
+
+	s.lck.Lock()
+	for c := range s.conns {
+		if bytes.Equal(c.uid, uid) {
+			conns = append(conns, c)
+		}
+	}
+	s.lck.Unlock()
+
+	if len(conns) == 0 {
+		return ErrNotConnected
+	}
+
+	for _, c := range conns {
+		if err := c.push(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HandlePush registers h to be called for each push of the same message type
+// as m. An error returned from h is reported to the server in the
+// acknowledgment.
+func (c *Client) HandlePush(m proto.Message, h func(proto.Message) error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.handlers[proto.MessageName(m)] = &pushHandler{
+		m: m,
+		h: h,
+	}
+}
+
+type pushHandler struct {
+	m proto.Message
+	h func(proto.Message) error
+}
+
+func (c *Client) handlePush(id uint32, b []byte) {
+	var ack PushAck
+	if err := c.dispatchPush(b); err != nil {
+		ack.Error = err.Error()
+	}
+
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+	if err := writeMsg(c.c, msgPushMsg, id, &ack); err != nil {
+		log.Printf("rpc: unable to acknowledge push: %s", err)
+	}
+}
+
+func (c *Client) dispatchPush(b []byte) error {
+	var p Push
+	if err := proto.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	c.lck.Lock()
+	ph := c.handlers[p.Type]
+	c.lck.Unlock()
+
+	if ph == nil {
+		return fmt.Errorf("no handler for %s", p.Type)
+	}
+
+	m := proto.Clone(ph.m)
+	m.Reset()
+	if err := proto.Unmarshal(p.Body, m); err != nil {
+		return err
+	}
+
+	return ph.h(m)
+}
@@ -1,14 +1,17 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 
@@ -29,114 +32,413 @@ func newListener(s *store.Store) (net.Listener, error) {
 	return tls.NewListener(nl, cfg), nil
 }
 
-func authenticate(c *tls.Conn, s *store.Store) (*store.User, error) {
-	for _, cert := range c.ConnectionState().PeerCertificates {
-		key, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
-		if err != nil {
-			continue
-		}
+func authenticate(c *tls.Conn, s *store.Store) ([]byte, *store.User, error) {
+	return s.Authenticate(c.ConnectionState().PeerCertificates)
+}
 
-		u, err := s.FindUser(key)
-		if err != nil {
-			continue
-		}
+// maxConcurrentRequests is the number of requests that are processed in
+// parallel for a single connection.
+const maxConcurrentRequests = 16
+
+// Each frame has a header of three big-endian uint32s: the message type, the
+// request id and the size of the body that follows. A response carries the
+// same type and request id as the request it answers.
+func readHeader(r io.Reader) (uint32, uint32, uint32, error) {
+	var h [3]uint32
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return 0, 0, 0, err
+	}
+	return h[0], h[1], h[2], nil
+}
 
-		return u, nil
+func readBody(r io.Reader, size uint32) ([]byte, error) {
+	b := make([]byte, int(size))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
 	}
+	return b, nil
+}
+
+// frameTooLargeError is returned by readMsg and readFrame for a frame whose
+// body exceeds the limit. The body is left unread, so the stream cannot be
+// resumed.
+type frameTooLargeError struct {
+	t, id     uint32
+	size, max uint32
+}
 
-	return nil, errors.New("certificate not authorized")
+func (e *frameTooLargeError) Error() string {
+	return fmt.Sprintf("frame of %d bytes for message %d exceeds the limit of %d",
+		e.size, e.t, e.max)
 }
 
-func readMsg(r io.Reader) (uint32, []byte, error) {
-	var t uint32
-	if err := binary.Read(r, binary.BigEndian, &t); err != nil {
-		return 0, nil, err
+// readMsg reads a frame whose body is at most max bytes.
+func readMsg(r io.Reader, max uint32) (uint32, uint32, []byte, error) {
+	t, id, size, err := readHeader(r)
+	if err != nil {
+		return 0, 0, nil, err
 	}
 
-	var s uint32
-	if err := binary.Read(r, binary.BigEndian, &s); err != nil {
-		return 0, nil, err
+	if size > max {
+		return 0, 0, nil, &frameTooLargeError{t, id, size, max}
 	}
 
-	b := make([]byte, int(s))
-	if _, err := io.ReadFull(r, b); err != nil {
-		return 0, nil, err
+	b, err := readBody(r, size)
+	if err != nil {
+		return 0, 0, nil, err
 	}
 
-	return t, b, nil
+	return t, id, b, nil
 }
 
-func readAndUnmarshalMsg(r io.Reader, t uint32, m proto.Message) error {
-	tr, br, err := readMsg(r)
+func writeMsg(w io.Writer, t, id uint32, m proto.Message) error {
+	b, err := proto.Marshal(m)
 	if err != nil {
 		return err
 	}
 
-	if tr != t {
-		return fmt.Errorf("wrong type: expected %d, got %d", t, tr)
+	// write the frame in a single call so that it is not split across
+	// multiple TLS records.
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, [3]uint32{t, id, uint32(len(b))}); err != nil {
+		return err
 	}
+	buf.Write(b)
 
-	return proto.Unmarshal(br, m)
+	_, err = w.Write(buf.Bytes())
+	return err
 }
 
-func writeMsg(c net.Conn, t uint32, m proto.Message) error {
-	b, err := proto.Marshal(m)
-	if err != nil {
+// conn is an authenticated connection to a client.
+type conn struct {
+	c         *tls.Conn
+	uid       []byte
+	user      *store.User
+	connected time.Time
+
+	writeTimeout time.Duration
+
+	wlck sync.Mutex
+
+	lck        sync.Mutex
+	nextPushId uint32
+	pushes     map[uint32]chan *PushAck
+	lastActive time.Time
+	status     string
+}
+
+func (c *conn) write(t, id uint32, m proto.Message) error {
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+
+	if err := c.c.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
 		return err
 	}
 
-	if err := binary.Write(c, binary.BigEndian, t); err != nil {
-		return err
+	metricFrameBytes.With("out").Observe(float64(proto.Size(m)))
+	return writeMsg(c.c, t, id, m)
+}
+
+// Server ...
+type Server struct {
+	l net.Listener
+	s *store.Store
+
+	maxFrameSize uint32
+	frameSizes   map[uint32]uint32
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	lck   sync.Mutex
+	conns map[*conn]bool
+}
+
+// Close ...
+func (s *Server) Close() error {
+	return s.l.Close()
+}
+
+// authenticateAndTrack authenticates the connection and, if successful, adds
+// it to the set of live connections. The outcome is audited once the
+// connection is tracked, so that the synced write does not hold up others.
+func (s *Server) authenticateAndTrack(c *tls.Conn) (*conn, error) {
+	addr := c.RemoteAddr().String()
+
+	cn, err := s.track(c)
+	if err != nil {
+		metricAuthFailures.Inc()
+		if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+			if err := s.s.AuditAuthFailure(addr, certs, err); err != nil {
+				log.Print(err)
+			}
+		}
+		return nil, err
 	}
 
-	if err := binary.Write(c, binary.BigEndian, uint32(len(b))); err != nil {
-		return err
+	if err := s.s.Audit(&store.AuditEntry{
+		Event:      store.AuditLogin,
+		Actor:      cn.uid,
+		RemoteAddr: addr,
+	}); err != nil {
+		log.Print(err)
 	}
 
-	if _, err := c.Write(b); err != nil {
-		return err
+	return cn, nil
+}
+
+// track authenticates the connection and, if successful, adds it to the set
+// of live connections. The lock is held throughout so that a concurrent
+// revocation either causes authentication to fail or finds the connection in
+// the set.
+func (s *Server) track(c *tls.Conn) (*conn, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	uid, user, err := authenticate(c, s.s)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	now := time.Now()
+	cn := &conn{
+		c:            c,
+		uid:          uid,
+		user:         user,
+		connected:    now,
+		writeTimeout: s.writeTimeout,
+		lastActive:   now,
+		pushes:       map[uint32]chan *PushAck{},
+	}
+	s.conns[cn] = true
+	metricSessionsOf(user).Inc()
+	return cn, nil
+}
+
+// frameSize returns the largest frame body accepted for messages of type t.
+func (s *Server) frameSize(t uint32) uint32 {
+	if max, ok := s.frameSizes[t]; ok && max < s.maxFrameSize {
+		return max
+	}
+	return s.maxFrameSize
+}
+
+func (s *Server) isTracked(c *conn) bool {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.conns[c]
+}
+
+func (s *Server) untrack(c *conn) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	// the connection may already have been removed by disconnect.
+	if s.conns[c] {
+		delete(s.conns, c)
+		metricSessionsOf(c.user).Dec()
+	}
+}
+
+// disconnect closes all live connections that were authenticated as the
+// user with the given id.
+func (s *Server) disconnect(uid []byte) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	for c := range s.conns {
+		if bytes.Equal(c.uid, uid) {
+			c.c.Close()
+			delete(s.conns, c)
+			metricSessionsOf(c.user).Dec()
+		}
+	}
 }
 
-func serve(c *tls.Conn, s *store.Store) {
+// handle dispatches a single request and writes its response, or an error
+// frame if the request failed. The connection is closed only if the response
+// cannot be written.
+func (s *Server) handle(ctx context.Context, c *conn, t, id uint32, b []byte) {
+	start := time.Now()
+	res, err := s.call(ctx, c, t, b)
+
+	name := metricMessageName(t)
+	metricRequests.With(name, metricCode(err)).Inc()
+	metricRequestDuration.With(name).ObserveSince(start)
+
+	if err != nil {
+		log.Print(err)
+		t, res = msgErrorMsg, toErrorRes(err)
+	}
+
+	if err := c.write(t, id, res); err != nil {
+		log.Print(err)
+		c.c.Close()
+	}
+}
+
+// call dispatches a request, turning a panic in its handler into an error so
+// that it only fails that request. The panic is logged along with the stack.
+func (s *Server) call(ctx context.Context, c *conn, t uint32, b []byte) (res proto.Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("rpc: panic handling message %d: %v\n%s", t, r, debug.Stack())
+			res, err = nil, Errorf(ErrorCode_INTERNAL, "panic: %v", r)
+		}
+	}()
+
+	return dispatch(ctx, c, t, b)
+}
+
+// deadlineReader is the part of a connection that readFrame uses.
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// readFrame reads the next frame from c. The header has the idle timeout to
+// arrive and the body the read timeout after it. A frameTooLargeError is
+// returned, with the body unread, if the body exceeds the limit for its type.
+func (s *Server) readFrame(c deadlineReader) (uint32, uint32, []byte, error) {
+	if err := c.SetReadDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+		return 0, 0, nil, err
+	}
+
+	t, id, size, err := readHeader(c)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	metricFrameBytes.With("in").Observe(float64(size))
+
+	if max := s.frameSize(t); size > max {
+		return 0, 0, nil, &frameTooLargeError{t, id, size, max}
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+		return 0, 0, nil, err
+	}
+
+	m, err := readBody(c, size)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return t, id, m, nil
+}
+
+func (s *Server) serve(c *tls.Conn) {
 	defer c.Close()
 
+	// the handshake is bounded so that peers cannot hold connections open
+	// without authenticating.
+	if err := c.SetDeadline(time.Now().Add(s.readTimeout)); err != nil {
+		log.Println(err)
+		return
+	}
+
 	if err := c.Handshake(); err != nil {
+		metricHandshakeFailures.Inc()
+		log.Println(err)
+		return
+	}
+
+	if err := c.SetDeadline(time.Time{}); err != nil {
 		log.Println(err)
 		return
 	}
 
-	_, err := authenticate(c, s)
+	cn, err := s.authenticateAndTrack(c)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	defer s.untrack(cn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = context.WithValue(ctx, storeKey, s.s)
+	ctx = context.WithValue(ctx, uidKey, cn.uid)
+	ctx = context.WithValue(ctx, connKey, cn)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, maxConcurrentRequests)
 
 	for {
-		t, m, err := readMsg(c)
-		if err == io.EOF {
+		t, id, m, err := s.readFrame(c)
+		if err == io.EOF || !s.isTracked(cn) {
+			// either the peer hung up or the connection was torn down
+			// because the user was revoked.
+			return
+		} else if err, ok := err.(*frameTooLargeError); ok {
+			// the body is not read, so there is no way to continue
+			// reading frames after rejecting it.
+			log.Print(err)
+			if err := cn.write(msgErrorMsg, err.id, toErrorRes(
+				Errorf(ErrorCode_TOO_LARGE, "%s", err))); err != nil {
+				log.Print(err)
+			}
 			return
 		} else if err != nil {
-			log.Panic(err)
+			log.Print(err)
 			return
 		}
 
-		if err := dispatch(c, t, m); err != nil {
-			log.Print(err)
-			return
+		cn.touch()
+
+		if t == msgPushMsg && id&pushFlag != 0 {
+			if err := cn.ack(id, m); err != nil {
+				log.Print(err)
+				return
+			}
+			continue
 		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(t, id uint32, m []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			s.handle(ctx, cn, t, id, m)
+		}(t, id, m)
 	}
 }
 
 // Serve ...
-func Serve(s *store.Store) (io.Closer, error) {
+func Serve(s *store.Store) (*Server, error) {
 	l, err := newListener(s)
 	if err != nil {
 		return nil, err
 	}
 
+	sizes, err := s.Config.FrameSizes()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	frameSizes := map[uint32]uint32{}
+	for name, size := range sizes {
+		frameSizes[msgTypeOf(name)] = size
+	}
+
+	srv := &Server{
+		l:            l,
+		s:            s,
+		maxFrameSize: s.Config.MaxFrameSize(),
+		frameSizes:   frameSizes,
+		readTimeout:  s.Config.ReadTimeout(),
+		writeTimeout: s.Config.WriteTimeout(),
+		idleTimeout:  s.Config.IdleTimeout(),
+		conns:        map[*conn]bool{},
+	}
+
+	s.OnRevoke(srv.disconnect)
+
 	go func() {
 		for {
 			c, err := l.Accept()
@@ -144,10 +446,11 @@ func Serve(s *store.Store) (io.Closer, error) {
 				// the listener was closed
 				return
 			}
+			metricAccepts.Inc()
 
-			go serve(c.(*tls.Conn), s)
+			go srv.serve(c.(*tls.Conn))
 		}
 	}()
 
-	return l, nil
+	return srv, nil
 }
@@ -1,18 +1,33 @@
 package rpc
 
 import (
+	"context"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
 
 	"pypibot/auth"
-	"pypibot/pb"
+	"pypibot/authz"
 	"pypibot/store"
 )
 
+// unregister removes the handler for requests of the same type as req, so
+// that a test's own handlers can be registered again when it is rerun.
+func unregister(req proto.Message) {
+	handlersLck.Lock()
+	defer handlersLck.Unlock()
+	delete(handlers, MsgType(req))
+}
+
 func createAndOpenStore(path string) (*store.Store, error) {
-	if err := store.Create(path); err != nil {
+	if err := store.Create(path, auth.RSA); err != nil {
 		return nil, err
 	}
 
@@ -34,7 +49,7 @@ func TestConnect(t *testing.T) {
 	}
 	defer s.Close()
 
-	_, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", pb.User_PERSON)
+	_, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_PERSON)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -44,12 +59,12 @@ func TestConnect(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	srvCrtPem, err := auth.ReadPem(filepath.Join(data, "srv.crt.pem"))
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	clt, err := Dial(":8081", srvCrtPem, crtPem, keyPem)
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -62,3 +77,990 @@ func TestConnect(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRevokeDisconnects(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	user, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	if _, err := clt.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RevokeUser(user.Id, "compromised"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clt.Ping(); err == nil {
+		t.Fatal("expected ping to fail after revocation")
+	}
+
+	clt, err = Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	if _, err := clt.Ping(); err == nil {
+		t.Fatal("expected revoked user to be rejected")
+	}
+}
+
+func TestDemoteDisconnects(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	god, crtPem, keyPem, err := s.CreateUser("god@email.com", "god", store.User_GOD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foo, _, _, err := s.CreateUser("foo@email.com", "foo", store.User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	if _, err := clt.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.UpdateUser(god.Id, func(u *store.User) error {
+		u.Type = store.User_PERSON
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clt.Revoke(foo.Id, "demoted"); err == nil {
+		t.Fatal("expected a demoted user's session to be closed")
+	}
+
+	clt, err = Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	if err := clt.Revoke(foo.Id, "demoted"); err == nil {
+		t.Fatal("expected a demoted user to be refused")
+	} else if e, ok := err.(*Error); !ok || e.Code != ErrorCode_PERMISSION_DENIED {
+		t.Fatalf("expected permission to be denied, got %v", err)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	newCrtPem, newKeyPem, err := clt.Renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pems := range [][2]*pem.Block{
+		{crtPem, keyPem},
+		{newCrtPem, newKeyPem},
+	} {
+		c, err := Dial(":8081", caCrtPem, pems[0], pems[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Ping(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectAfterCARotation(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	user, _, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCAPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RotateCA(); err != nil {
+		t.Fatal(err)
+	}
+
+	crtPem, err := s.ReissueUserCert(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.FinishCARotation(); err != nil {
+		t.Fatal(err)
+	}
+
+	newCAPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, caPem := range []*pem.Block{oldCAPem, newCAPem} {
+		clt, err := Dial(":8081", caPem, crtPem, keyPem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := clt.Ping(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := clt.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectKeyTypes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	if err := store.Create(data, auth.ECDSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kt := range []auth.KeyType{auth.RSA, auth.ECDSA, auth.Ed25519} {
+		_, crtPem, keyPem, err := s.CreateUserWithKeyType(
+			kt.String()+"@email.com",
+			kt.String(),
+			store.User_BOT,
+			kt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := clt.Ping(); err != nil {
+			t.Fatalf("%s: %s", kt, err)
+		}
+
+		if err := clt.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	errs := make(chan error)
+	for i := 0; i < 50; i++ {
+		go func(id int32) {
+			var res PingRes
+			if err := clt.Call(&PingReq{Id: id}, &res); err != nil {
+				errs <- err
+			} else if res.Id != id {
+				errs <- fmt.Errorf("expected id %d, got %d", id, res.Id)
+			} else {
+				errs <- nil
+			}
+		}(int32(i))
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	user, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := user.Id
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if err := srv.Push(uid, &Notice{Text: "hi"}); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	// the server tracks the connection before it reads the first call.
+	if _, err := clt.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Push(uid, &Notice{Text: "hi"}); err == nil {
+		t.Fatal("push without a handler was acknowledged")
+	}
+
+	notices := make(chan *Notice, 1)
+	clt.HandlePush(&Notice{}, func(m proto.Message) error {
+		n := m.(*Notice)
+		if n.Text == "fail" {
+			return fmt.Errorf("failed")
+		}
+		notices <- n
+		return nil
+	})
+
+	if err := srv.Push(uid, &Notice{From: "server", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	n := <-notices
+	if n.From != "server" || n.Text != "hi" {
+		t.Fatalf("unexpected notice: %v", n)
+	}
+
+	if err := srv.Push(uid, &Notice{Text: "fail"}); err == nil || err.Error() != "failed" {
+		t.Fatalf("expected handler error, got %v", err)
+	}
+
+	if _, err := clt.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepeatedAck(t *testing.T) {
+	ch := make(chan *PushAck, 1)
+	c := &conn{
+		pushes: map[uint32]chan *PushAck{
+			pushFlag | 1: ch,
+		},
+	}
+
+	b, err := proto.Marshal(&PushAck{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// neither a repeated acknowledgment nor one for an unknown push may
+	// block.
+	for _, id := range []uint32{pushFlag | 1, pushFlag | 1, pushFlag | 2} {
+		if err := c.ack(id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(ch) != 1 {
+		t.Fatal("expected the acknowledgment to be delivered")
+	}
+
+	if len(c.pushes) != 0 {
+		t.Fatal("expected the push to be forgotten once acknowledged")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	user, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := user.Id
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if srv.IsOnline(uid) || len(srv.Sessions()) != 0 {
+		t.Fatal("user is online before connecting")
+	}
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clt.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !srv.IsOnline(uid) {
+		t.Fatal("user is not online after connecting")
+	}
+
+	sessions := srv.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+
+	ss := sessions[0]
+	if ss.User.Email != "foo@email.com" {
+		t.Fatalf("unexpected user: %s", ss.User.Email)
+	}
+
+	if ss.LastActive.Before(ss.Connected) {
+		t.Fatal("last activity precedes connection")
+	}
+
+	if ss.TlsVersion == 0 || ss.Serial == "" {
+		t.Fatal("session is missing TLS details")
+	}
+
+	if err := clt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server notices the disconnect asynchronously.
+	for i := 0; srv.IsOnline(uid); i++ {
+		if i == 100 {
+			t.Fatal("user is still online after disconnecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Register(authz.Anyone, func(ctx context.Context, user *store.User, req *Notice) (*Notice, error) {
+		return &Notice{
+			From: user.Email,
+			Text: req.Text,
+		}, nil
+	})
+	defer unregister(&Notice{})
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	var res Notice
+	if err := clt.Call(&Notice{Text: "hi"}, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.From != "foo@email.com" || res.Text != "hi" {
+		t.Fatalf("unexpected response: %v", &res)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Register(authz.Anyone, func(ctx context.Context, user *store.User, req *Push) (*Push, error) {
+		switch req.Type {
+		case "panic":
+			panic("boom")
+		case "internal":
+			return nil, fmt.Errorf("unable to open %s", "/secret/path")
+		}
+		return nil, &Error{
+			Code:    ErrorCode_BAD_REQUEST,
+			Message: "bad push",
+			Details: []string{"type is required"},
+		}
+	})
+	defer unregister(&Push{})
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clt.Close()
+
+	for _, test := range []struct {
+		req  proto.Message
+		code ErrorCode
+	}{
+		{&PushAck{}, ErrorCode_INVALID_TYPE},
+		{&Push{}, ErrorCode_BAD_REQUEST},
+		{&Push{Type: "panic"}, ErrorCode_INTERNAL},
+		{&Push{Type: "internal"}, ErrorCode_INTERNAL},
+	} {
+		var res Push
+		err := clt.Call(test.req, &res)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("expected *Error, got %v", err)
+		}
+
+		if e.Code != test.code {
+			t.Fatalf("expected %s, got %s", test.code, e.Code)
+		}
+
+		if test.code == ErrorCode_BAD_REQUEST && len(e.Details) != 1 {
+			t.Fatalf("expected details, got %v", e.Details)
+		}
+
+		// the detail of internal errors stays on the server.
+		if test.code == ErrorCode_INTERNAL && e.Message != internalErrorMessage {
+			t.Fatalf("expected %q, got %q", internalErrorMessage, e.Message)
+		}
+	}
+
+	// the connection survives failed requests.
+	if _, err := clt.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFrameSizeLimits(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, crtPem, keyPem, err := s.CreateUser("foo@email.com", "foo", store.User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Config.Rpc.MaxFrameSize = 16
+	s.Config.Rpc.FrameSize = []string{"rpc.PingReq 4"}
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		req proto.Message
+		err bool
+	}{
+		{&PingReq{Id: 1}, false},
+		{&PingReq{Id: 1 << 30}, true},
+		{&Notice{Text: "more than sixteen bytes"}, true},
+	} {
+		clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var res PingRes
+		err = clt.Call(test.req, &res)
+		if !test.err {
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else if e, ok := err.(*Error); !ok || e.Code != ErrorCode_TOO_LARGE {
+			t.Fatalf("expected TOO_LARGE, got %v", err)
+		}
+
+		clt.Close()
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	victims := 0
+
+	ops := []struct {
+		name    string
+		allowed authz.Policy
+		call    func(c *Client) error
+	}{
+		{"ping", authz.Anyone, func(c *Client) error {
+			_, err := c.Ping()
+			return err
+		}},
+		{"renew", authz.Anyone, func(c *Client) error {
+			_, _, err := c.Renew()
+			return err
+		}},
+		{"revoke", authz.Admins, func(c *Client) error {
+			victims++
+			victim, _, _, err := s.CreateUser(fmt.Sprintf("victim%d@email.com", victims), "victim", store.User_PERSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c.Revoke(victim.Id, "test")
+		}},
+		{"status", authz.Bots, func(c *Client) error {
+			return c.ReportStatus("ok")
+		}},
+	}
+
+	for _, typ := range []store.User_UserType{
+		store.User_PERSON,
+		store.User_BOT,
+		store.User_GOD,
+	} {
+		user, crtPem, keyPem, err := s.CreateUser(typ.String()+"@email.com", "foo", typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, op := range ops {
+			err := op.call(clt)
+			if op.allowed.Permits(user) {
+				if err != nil {
+					t.Fatalf("%s/%s: %s", typ, op.name, err)
+				}
+			} else if e, ok := err.(*Error); !ok || e.Code != ErrorCode_PERMISSION_DENIED {
+				t.Fatalf("%s/%s: expected PERMISSION_DENIED, got %v", typ, op.name, err)
+			}
+		}
+
+		clt.Close()
+	}
+
+	// every login and every attempt at a privileged call is audited.
+	events := map[string]int{}
+	if err := s.ForEachAuditEntry(0, func(e *store.AuditEntry) error {
+		events[e.Event]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if events[store.AuditLogin] != 3 || events[store.AuditRpc] != 3 {
+		t.Fatalf("expected 3 logins and 3 privileged calls, got %v", events)
+	}
+}
+
+// waitFor polls f until it returns true or a second has passed, since the
+// server updates some metrics after the client has moved on.
+func waitFor(t *testing.T, what string, f func() bool) {
+	for deadline := time.Now().Add(time.Second); !f(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	s, err := createAndOpenStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, crtPem, keyPem, err := s.CreateUser("bot@email.com", "bot", store.User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, revokedCrtPem, revokedKeyPem, err := s.CreateUser("foo@email.com", "foo", store.User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RevokeUser(revoked.Id, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(data, "ca.crt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// metrics are shared by every server in the process, so only changes
+	// are checked.
+	accepts := metricAccepts.Value()
+	handshakeFailures := metricHandshakeFailures.Value()
+	authFailures := metricAuthFailures.Value()
+	pings := metricRequests.With("rpc.PingReq", "OK").Value()
+	invalid := metricRequests.With("unknown", "INVALID_TYPE").Value()
+	pingDurations := metricRequestDuration.With("rpc.PingReq").Count()
+	framesIn := metricFrameBytes.With("in").Count()
+	framesOut := metricFrameBytes.With("out").Count()
+	bots := metricSessions.With("BOT").Value()
+
+	clt, err := Dial(":8081", caCrtPem, crtPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := clt.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := clt.Call(&PushAck{}, &PushAck{}); err == nil {
+		t.Fatal("expected an error for a message without a handler")
+	}
+
+	if v := metricSessions.With("BOT").Value(); v != bots+1 {
+		t.Fatalf("expected %d bot sessions, got %d", bots+1, v)
+	}
+
+	if err := clt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the session to end", func() bool {
+		return metricSessions.With("BOT").Value() == bots
+	})
+
+	// a revoked user fails to authenticate.
+	clt, err = Dial(":8081", caCrtPem, revokedCrtPem, revokedKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt.Ping()
+	clt.Close()
+
+	// a peer that does not speak TLS fails the handshake.
+	c, err := net.Dial("tcp", "127.0.0.1:8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	c.Close()
+
+	waitFor(t, "the failures to be counted", func() bool {
+		return metricAuthFailures.Value() == authFailures+1 &&
+			metricHandshakeFailures.Value() == handshakeFailures+1
+	})
+
+	for _, test := range []struct {
+		name     string
+		got, exp uint64
+	}{
+		{"accepts", metricAccepts.Value(), accepts + 3},
+		{"pings", metricRequests.With("rpc.PingReq", "OK").Value(), pings + 2},
+		{"invalid requests", metricRequests.With("unknown", "INVALID_TYPE").Value(), invalid + 1},
+		{"ping durations", metricRequestDuration.With("rpc.PingReq").Count(), pingDurations + 2},
+		{"frames in", metricFrameBytes.With("in").Count(), framesIn + 3},
+		{"frames out", metricFrameBytes.With("out").Count(), framesOut + 3},
+	} {
+		if test.got != test.exp {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.exp, test.got)
+		}
+	}
+}
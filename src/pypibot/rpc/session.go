@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"bytes"
+	"time"
+
+	"pypibot/store"
+)
+
+// Session describes a live, authenticated connection.
+type Session struct {
+	// Uid is the id of the user the connection was authenticated as.
+	Uid  []byte
+	User *store.User
+
+	RemoteAddr string
+	Connected  time.Time
+	LastActive time.Time
+
+	TlsVersion  uint16
+	CipherSuite uint16
+	ServerName  string
+
+	// Serial is the serial number of the client cert, as a decimal string.
+	Serial string
+
+	// Status is the status last reported by a bot.
+	Status string
+}
+
+// touch records activity on the connection.
+func (c *conn) touch() {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.lastActive = time.Now()
+}
+
+func (c *conn) setStatus(status string) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.status = status
+}
+
+func (c *conn) session() *Session {
+	c.lck.Lock()
+	lastActive, status := c.lastActive, c.status
+	c.lck.Unlock()
+
+	st := c.c.ConnectionState()
+
+	var serial string
+	if len(st.PeerCertificates) > 0 {
+		serial = st.PeerCertificates[0].SerialNumber.String()
+	}
+
+	return &Session{
+		Uid:         c.uid,
+		User:        c.user,
+		RemoteAddr:  c.c.RemoteAddr().String(),
+		Connected:   c.connected,
+		LastActive:  lastActive,
+		TlsVersion:  st.Version,
+		CipherSuite: st.CipherSuite,
+		ServerName:  st.ServerName,
+		Serial:      serial,
+		Status:      status,
+	}
+}
+
+// Sessions returns a snapshot of all live sessions.
+func (s *Server) Sessions() []*Session {
+	s.lck.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.lck.Unlock()
+
+	sessions := make([]*Session, 0, len(conns))
+	for _, c := range conns {
+		sessions = append(sessions, c.session())
+	}
+	return sessions
+}
+
+// IsOnline indicates whether the user with the given id has at least one live
+// session.
+func (s *Server) IsOnline(uid []byte) bool {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	for c := range s.conns {
+		if bytes.Equal(c.uid, uid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+
+	"pypibot/auth"
+)
+
+// apiTokenEnv names the environment variable holding the bearer token with
+// which revoke-user -api and backup -api authenticate.
+const apiTokenEnv = "PYPIBOT_API_TOKEN"
+
+// bearerTransport adds a bearer token to every request.
+type bearerTransport struct {
+	token string
+	rt    http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.rt.RoundTrip(r)
+}
+
+// apiClient returns a client for the api of a running server, whose cert is
+// verified against the store's CA in caFile, that authenticates with token.
+func apiClient(caFile, token string) (*http.Client, error) {
+	caPem, err := auth.ReadPem(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caCrt, err := x509.ParseCertificate(caPem.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	p := x509.NewCertPool()
+	p.AddCert(caCrt)
+
+	return &http.Client{
+		Transport: &bearerTransport{
+			token: token,
+			rt: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: p,
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"pypibot/store"
+)
+
+// doVerifyAudit checks the audit log's chain and its end against audit.head.
+// The digest of the last entry is printed so that it can be kept elsewhere
+// and compared later, since a log rewritten along with audit.head is only
+// detected that way.
+func doVerifyAudit(args []string) {
+	flags := flag.NewFlagSet("verify-audit", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	n, head, err := s.VerifyAudit()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d entries verified, last digest %s\n", n, head)
+}
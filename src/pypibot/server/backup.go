@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"pypibot/store"
+)
+
+// fetchBackup downloads a backup from the api of a running server, whose
+// cert is verified against the CA in the store at dbPath.
+func fetchBackup(url, token, dbPath string, w io.Writer) error {
+	c, err := apiClient(filepath.Join(dbPath, "ca.crt.pem"), token)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Get(url + "/api/v1/backup")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup failed: %s", res.Status)
+	}
+
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// doBackup writes an archive of the store to a file. The server holds the
+// store open, so while it is running the archive is instead fetched with
+// -api from its api, with the token in PYPIBOT_API_TOKEN.
+func doBackup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagApi := flags.String("api", "", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage %s backup [-api https://host:port] file\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	token := os.Getenv(apiTokenEnv)
+	if *flagApi != "" && token == "" {
+		log.Panicf("%s must hold a token to use -api", apiTokenEnv)
+	}
+
+	f, err := os.OpenFile(flags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	if *flagApi != "" {
+		err = fetchBackup(*flagApi, token, *flagDbPath, f)
+	} else {
+		err = backupStore(*flagDbPath, f)
+	}
+
+	if err != nil {
+		os.Remove(flags.Arg(0))
+		log.Panic(err)
+	}
+
+	if err := f.Close(); err != nil {
+		log.Panic(err)
+	}
+}
+
+func backupStore(dbPath string, w io.Writer) error {
+	s, err := store.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.Audit(&store.AuditEntry{
+		Event: store.AuditBackup,
+	}); err != nil {
+		return err
+	}
+
+	return s.Backup(w)
+}
+
+func doRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage %s restore [-dbpath path] file\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	if err := store.Restore(f, *flagDbPath); err != nil {
+		log.Panic(err)
+	}
+}
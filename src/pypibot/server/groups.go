@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"pypibot/store"
+)
+
+// userId decodes the hex encoded id of a user and checks that the user
+// exists.
+func userId(s *store.Store, hexId string) []byte {
+	id, err := hex.DecodeString(hexId)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if _, err := s.FindUser(id); err != nil {
+		log.Panicf("unable to find user %s: %s", hexId, err)
+	}
+
+	return id
+}
+
+func doCreateGroup(args []string) {
+	flags := flag.NewFlagSet("create-group", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagDesc := flags.String("desc", "", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage %s create-group [-desc description] name\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if err := s.CreateGroup(flags.Arg(0), *flagDesc); err != nil {
+		log.Panic(err)
+	}
+}
+
+func doDeleteGroup(args []string) {
+	flags := flag.NewFlagSet("delete-group", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage %s delete-group name\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if err := s.DeleteGroup(flags.Arg(0)); err != nil {
+		log.Panic(err)
+	}
+}
+
+func doGroupMember(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage %s %s group id\n", os.Args[0], cmd)
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	id := userId(s, flags.Arg(1))
+
+	if cmd == "add-member" {
+		err = s.AddGroupMember(flags.Arg(0), id)
+	} else {
+		err = s.RemoveGroupMember(flags.Arg(0), id)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func doListGroups(args []string) {
+	flags := flag.NewFlagSet("list-groups", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if err := s.ForEachGroup(func(g *store.Group) error {
+		fmt.Printf("%s\t%s\n", g.Name, g.Description)
+		for _, m := range g.Members {
+			user, err := s.FindUser(m)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("  %s\t%x\n", user.Email, m)
+		}
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+}
+
+// doGrant handles both grant and revoke-grant, which take the same flags.
+func doGrant(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagUser := flags.String("user", "", "")
+	flagGroup := flags.String("group", "", "")
+	flagBot := flags.String("bot", "", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (*flagUser == "") == (*flagGroup == "") {
+		fmt.Fprintf(os.Stderr, "usage %s %s (-user id | -group name) [-bot id] action\n",
+			os.Args[0], cmd)
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	g := &store.Grant{
+		Group:  *flagGroup,
+		Action: flags.Arg(0),
+	}
+
+	if *flagUser != "" {
+		g.User = userId(s, *flagUser)
+	}
+
+	if *flagBot != "" {
+		g.Bot = userId(s, *flagBot)
+	}
+
+	if cmd == "grant" {
+		err = s.AddGrant(g)
+	} else {
+		err = s.RemoveGrant(g)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func doListGrants(args []string) {
+	flags := flag.NewFlagSet("list-grants", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if err := s.ForEachGrant(func(g *store.Grant) error {
+		who := "group " + g.Group
+		if g.Group == "" {
+			who = fmt.Sprintf("user %x", g.User)
+		}
+
+		bot := "all bots"
+		if len(g.Bot) != 0 {
+			bot = fmt.Sprintf("bot %x", g.Bot)
+		}
+
+		fmt.Printf("%s may %s on %s\n", who, g.Action, bot)
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+}
+
+func doCheckPermission(args []string) {
+	flags := flag.NewFlagSet("check-permission", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		fmt.Fprintf(os.Stderr, "usage %s check-permission user-id action bot-id\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	ok, err := s.Permits(userId(s, flags.Arg(0)), flags.Arg(1), userId(s, flags.Arg(2)))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if !ok {
+		fmt.Println("denied")
+		os.Exit(1)
+	}
+
+	fmt.Println("permitted")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"pypibot/auth"
+)
+
+// The passphrase of an encrypted CA key is read from PYPIBOT_PASSPHRASE, or
+// the file named by PYPIBOT_PASSPHRASE_FILE, or asked for on the terminal.
+// Commands that write keys take -encrypt with the source of the passphrase
+// with which to encrypt them: env:NAME, file:PATH or prompt.
+
+// encryptPassphrase returns the passphrase source given to -encrypt, or nil
+// if keys are to be written unencrypted. The passphrase is obtained right
+// away so that a mistyped one fails the command before anything is changed.
+func encryptPassphrase(spec string) auth.Passphrase {
+	if spec == "" {
+		return nil
+	}
+
+	p, err := auth.ParsePassphrase(spec, true)
+	if err != nil {
+		log.Panic(err)
+	}
+	p = auth.CachePassphrase(p)
+
+	if _, err := p(); err != nil {
+		log.Panic(err)
+	}
+
+	return p
+}
+
+// writeCrtAndKey writes a user's cert and key, encrypting the key with p if
+// it is not nil.
+func writeCrtAndKey(crtPem *pem.Block, crtFile string, keyPem *pem.Block, keyFile string, p auth.Passphrase) error {
+	if err := auth.WritePem(crtPem, crtFile); err != nil {
+		return err
+	}
+
+	return auth.WriteKeyPem(keyPem, keyFile, p)
+}
+
+// doEncryptKey encrypts existing key files, such as the CA key of a store
+// created without -encrypt, in place.
+func doEncryptKey(args []string) {
+	flags := flag.NewFlagSet("encrypt-key", flag.PanicOnError)
+	flagEncrypt := flags.String("encrypt", "prompt", "")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage %s encrypt-key [-encrypt env:NAME|file:PATH|prompt] file...\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	p := encryptPassphrase(*flagEncrypt)
+
+	for _, f := range flags.Args() {
+		if enc, err := auth.IsEncryptedFile(f); err != nil {
+			log.Panic(err)
+		} else if enc {
+			fmt.Printf("%s is already encrypted\n", f)
+			continue
+		}
+
+		keyPem, err := auth.ReadPem(f)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if _, err := auth.ParsePrivateKey(keyPem); err != nil {
+			log.Panicf("%s: %s", f, err)
+		}
+
+		if err := auth.WriteKeyPem(keyPem, f, p); err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// doDecryptKey decrypts key files in place.
+func doDecryptKey(args []string) {
+	flags := flag.NewFlagSet("decrypt-key", flag.PanicOnError)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage %s decrypt-key file...\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	for _, f := range flags.Args() {
+		if enc, err := auth.IsEncryptedFile(f); err != nil {
+			log.Panic(err)
+		} else if !enc {
+			fmt.Printf("%s is not encrypted\n", f)
+			continue
+		}
+
+		keyPem, err := auth.ReadPem(f)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if err := auth.WriteKeyPem(keyPem, f, nil); err != nil {
+			log.Panic(err)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"pypibot/api"
@@ -24,23 +31,60 @@ func doServe(args []string) {
 		log.Panic(err)
 	}
 
-	if _, err := rpc.Serve(s); err != nil {
+	// ask for the passphrase of an encrypted CA key now, rather than when
+	// the first cert is issued.
+	if err := s.CheckCAKey(); err != nil {
+		log.Panic(err)
+	}
+
+	srv, err := rpc.Serve(s)
+	if err != nil {
 		log.Panic(err)
 	}
 
 	r := http.NewServeMux()
 
-	api.Install(r, s)
+	api.Install(r, s, srv, api.StoreAuthenticator(s))
+
+	if !s.Config.Web.Tls {
+		log.Printf("warning: serving the api without TLS, set tls=true in [web]; bearer tokens, backups and user creation are refused")
+		log.Panic(http.ListenAndServe(s.Config.Web.Addr, r))
+	}
+
+	cfg, err := s.WebTlsConfig()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	web := &http.Server{
+		Addr:      s.Config.Web.Addr,
+		Handler:   r,
+		TLSConfig: cfg,
+	}
 
-	log.Panic(http.ListenAndServe(s.Config.Web.Addr, r))
+	log.Panic(web.ListenAndServeTLS("", ""))
 }
 
 func doInitStore(args []string) {
 	flags := flag.NewFlagSet("init-store", flag.PanicOnError)
 	flagDbPath := flags.String("dbpath", "data", "")
+	flagKeyType := flags.String("keyType", "rsa", "")
+	flagEncrypt := flags.String("encrypt", "", "")
 	flags.Parse(args)
 
-	if err := store.Create(*flagDbPath); err != nil {
+	kt, err := auth.ParseKeyType(*flagKeyType)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// the CA key is read back to issue the server's cert, so the same
+	// passphrase is used to decrypt it.
+	p := encryptPassphrase(*flagEncrypt)
+	if p != nil {
+		auth.SetPassphrase(p)
+	}
+
+	if err := store.CreateEncrypted(*flagDbPath, kt, p); err != nil {
 		log.Panic(err)
 	}
 
@@ -60,6 +104,8 @@ func doAddUser(args []string) {
 	flags := flag.NewFlagSet("add-user", flag.PanicOnError)
 	flagDbPath := flags.String("dbpath", "data", "")
 	flagUserType := flags.String("type", "PERSON", "")
+	flagKeyType := flags.String("keyType", "", "")
+	flagEncrypt := flags.String("encrypt", "", "")
 	flags.Parse(args)
 
 	if flags.NArg() != 4 {
@@ -67,6 +113,8 @@ func doAddUser(args []string) {
 		os.Exit(1)
 	}
 
+	p := encryptPassphrase(*flagEncrypt)
+
 	s, err := store.Open(*flagDbPath)
 	if err != nil {
 		log.Panic(err)
@@ -77,18 +125,347 @@ func doAddUser(args []string) {
 		log.Panic(err)
 	}
 
-	_, crtPem, keyPem, err := s.CreateUser(flags.Arg(0), flags.Arg(1), t)
+	kt, err := s.Config.KeyType()
 	if err != nil {
 		log.Panic(err)
 	}
 
-	if err := auth.WriteBothPems(
+	if *flagKeyType != "" {
+		kt, err = auth.ParseKeyType(*flagKeyType)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	user, crtPem, keyPem, err := s.CreateUserWithKeyType(flags.Arg(0), flags.Arg(1), t, kt)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if err := writeCrtAndKey(
 		crtPem,
 		flags.Arg(2),
 		keyPem,
-		flags.Arg(3)); err != nil {
+		flags.Arg(3),
+		p); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println(hex.EncodeToString(user.Id))
+}
+
+func doInviteUser(args []string) {
+	flags := flag.NewFlagSet("invite-user", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagUserType := flags.String("type", "PERSON", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage %s invite-user email name\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	t, err := stringToUserType(*flagUserType)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	token, err := s.InviteUser(flags.Arg(0), flags.Arg(1), t)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	caPem, err := s.CACert()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// the fingerprint is given to the user along with the token, so that
+	// the client can verify the server without a copy of the CA.
+	fmt.Println(token)
+	fmt.Printf("ca fingerprint %x\n", auth.Fingerprint(caPem))
+}
+
+// revokeUserWithApi revokes a user through the api of the server at
+// baseUrl, which is verified with the store's CA in caFile. This is how a
+// user is revoked while the server is running, since the server holds the
+// store open, and it also disconnects the user's live sessions.
+func revokeUserWithApi(baseUrl, token, caFile, hexId, reason string) error {
+	c, err := apiClient(caFile, token)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("DELETE",
+		fmt.Sprintf("%s/api/v1/users/%s?reason=%s", baseUrl, url.PathEscape(hexId), url.QueryEscape(reason)),
+		nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("revoke failed: %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// doRevokeUser revokes a user. The store can only be opened while the
+// server is stopped, so with -api the user is instead revoked through the
+// running server's api with the token in PYPIBOT_API_TOKEN.
+func doRevokeUser(args []string) {
+	flags := flag.NewFlagSet("revoke-user", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagReason := flags.String("reason", "", "")
+	flagApi := flags.String("api", "", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage %s revoke-user [-reason reason] [-api https://host:port] id\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	if *flagApi != "" {
+		token := os.Getenv(apiTokenEnv)
+		if token == "" {
+			log.Panicf("%s must hold a token to use -api", apiTokenEnv)
+		}
+
+		if err := revokeUserWithApi(
+			*flagApi,
+			token,
+			filepath.Join(*flagDbPath, "ca.crt.pem"),
+			flags.Arg(0),
+			*flagReason); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panicf("%s (use -api if the server is running)", err)
+	}
+	defer s.Close()
+
+	if err := s.RevokeUser(userId(s, flags.Arg(0)), *flagReason); err != nil {
+		log.Panic(err)
+	}
+}
+
+func doRotateUserCert(args []string) {
+	flags := flag.NewFlagSet("rotate-user-cert", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagEncrypt := flags.String("encrypt", "", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 {
+		fmt.Fprintf(os.Stderr, "usage %s rotate-user-cert [-encrypt source] id crt key\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	p := encryptPassphrase(*flagEncrypt)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	_, crtPem, keyPem, err := s.RotateUserKey(userId(s, flags.Arg(0)))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if err := writeCrtAndKey(
+		crtPem,
+		flags.Arg(1),
+		keyPem,
+		flags.Arg(2),
+		p); err != nil {
+		log.Panic(err)
+	}
+}
+
+func printCAStatus(s *store.Store) {
+	st, err := s.CAStatus()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("rotating: %t\n", st.Rotating)
+	fmt.Printf("users on current CA: %d\n", st.Current)
+	fmt.Printf("users on old CA: %d\n", st.Old)
+}
+
+// reissueUserCerts writes a cert from the new CA for every active user to
+// dir, named by the user's email. A user whose cert cannot be reissued is
+// reported to w and skipped, so the others are still written, and an error
+// is returned once all have been tried.
+func reissueUserCerts(s *store.Store, dir string, w io.Writer) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	var ids [][]byte
+	var emails []string
+	if err := s.ForEachUser(func(id []byte, user *store.User) error {
+		if !user.IsRevoked() {
+			ids = append(ids, append([]byte{}, id...))
+			emails = append(emails, user.Email)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	failed := 0
+	for i, id := range ids {
+		// the email is checked first so that no cert is issued that
+		// cannot be written.
+		err := checkEmailFilename(emails[i])
+		if err == nil {
+			var crtPem *pem.Block
+			if crtPem, err = s.ReissueUserCert(id); err == nil {
+				err = auth.WritePem(crtPem, filepath.Join(dir, emails[i]+".crt.pem"))
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(w, "%s: %s\n", emails[i], err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d certs could not be reissued", failed, len(ids))
+	}
+	return nil
+}
+
+func doRotateCA(args []string) {
+	flags := flag.NewFlagSet("rotate-ca", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagFinish := flags.Bool("finish", false, "")
+	flagForce := flags.Bool("force", false, "")
+	flagReissue := flags.String("reissue", "", "")
+	flags.Parse(args)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if *flagFinish {
+		st, err := s.CAStatus()
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if st.Old > 0 && !*flagForce {
+			fmt.Fprintf(os.Stderr,
+				"%d users only hold certs from the old CA, use -force to finish anyway\n",
+				st.Old)
+			os.Exit(1)
+		}
+
+		if err := s.FinishCARotation(); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		if err := s.RotateCA(); err != nil {
+			log.Panic(err)
+		}
+
+		if *flagReissue != "" {
+			if err := reissueUserCerts(s, *flagReissue, os.Stderr); err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+
+	printCAStatus(s)
+}
+
+func doCAStatus(args []string) {
+	flags := flag.NewFlagSet("ca-status", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
 		log.Panic(err)
 	}
+	defer s.Close()
+
+	printCAStatus(s)
+}
+
+func doIssueServerCert(args []string) {
+	flags := flag.NewFlagSet("issue-server-cert", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if err := s.IssueServerCert(); err != nil {
+		log.Panic(err)
+	}
+}
+
+func doVerifyIndexes(args []string) {
+	flags := flag.NewFlagSet("verify-indexes", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagRebuild := flags.Bool("rebuild", false, "")
+	flags.Parse(args)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if *flagRebuild {
+		conflicts, err := s.RebuildIndexes()
+		if err != nil {
+			log.Panic(err)
+		}
+
+		for _, c := range conflicts {
+			fmt.Printf("conflict: %s\n", c)
+		}
+	}
+
+	problems, err := s.VerifyIndexes()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
 }
 
 func usage() {
@@ -110,6 +487,54 @@ func main() {
 		doInitStore(args[2:])
 	case "add-user":
 		doAddUser(args[2:])
+	case "invite-user":
+		doInviteUser(args[2:])
+	case "revoke-user":
+		doRevokeUser(args[2:])
+	case "rotate-user-cert":
+		doRotateUserCert(args[2:])
+	case "rotate-ca":
+		doRotateCA(args[2:])
+	case "ca-status":
+		doCAStatus(args[2:])
+	case "issue-server-cert":
+		doIssueServerCert(args[2:])
+	case "create-group":
+		doCreateGroup(args[2:])
+	case "delete-group":
+		doDeleteGroup(args[2:])
+	case "add-member", "remove-member":
+		doGroupMember(args[1], args[2:])
+	case "list-groups":
+		doListGroups(args[2:])
+	case "grant", "revoke-grant":
+		doGrant(args[1], args[2:])
+	case "list-grants":
+		doListGrants(args[2:])
+	case "check-permission":
+		doCheckPermission(args[2:])
+	case "verify-indexes":
+		doVerifyIndexes(args[2:])
+	case "issue-token":
+		doIssueToken(args[2:])
+	case "revoke-token":
+		doRevokeToken(args[2:])
+	case "list-tokens":
+		doListTokens(args[2:])
+	case "verify-audit":
+		doVerifyAudit(args[2:])
+	case "export-users":
+		doExportUsers(args[2:])
+	case "import-users":
+		doImportUsers(args[2:])
+	case "backup":
+		doBackup(args[2:])
+	case "restore":
+		doRestore(args[2:])
+	case "encrypt-key":
+		doEncryptKey(args[2:])
+	case "decrypt-key":
+		doDecryptKey(args[2:])
 	default:
 		usage()
 	}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pypibot/api"
+	"pypibot/auth"
+	"pypibot/rpc"
+	"pypibot/store"
+)
+
+func TestRevokeUserWithApi(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+
+	if err := store.Create(data, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Config.Rpc.Addr = "127.0.0.1:0"
+
+	srv, err := rpc.Serve(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	god, _, _, err := s.CreateUser("god@email.com", "god", store.User_GOD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foo, _, _, err := s.CreateUser("foo@email.com", "foo", store.User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.IssueToken(god.Id, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := s.WebTlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := http.NewServeMux()
+	api.Install(r, s, srv, api.StoreAuthenticator(s))
+
+	h := httptest.NewUnstartedServer(r)
+	h.TLS = cfg
+	h.StartTLS()
+	defer h.Close()
+
+	// the server's cert is issued for localhost.
+	_, port, err := net.SplitHostPort(h.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "https://localhost:" + port
+	caFile := filepath.Join(data, "ca.crt.pem")
+
+	if err := revokeUserWithApi(url, "bogus", caFile, hex.EncodeToString(foo.Id), "left"); err == nil {
+		t.Fatal("expected an error with a bad token")
+	}
+
+	if err := revokeUserWithApi(url, token, caFile, hex.EncodeToString(foo.Id), "left"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := s.FindUser(foo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !user.IsRevoked() || user.Revocation.Reason != "left" {
+		t.Fatalf("expected the user to be revoked for \"left\", got %v", user.Revocation)
+	}
+
+	if err := revokeUserWithApi(url, token, caFile, hex.EncodeToString(foo.Id), ""); err == nil {
+		t.Fatal("expected an error revoking a user twice")
+	}
+}
+
+func TestReissueUserCerts(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+	out := filepath.Join(tmp, "out")
+
+	if err := store.Create(data, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, email := range []string{"a@email.com", "../b@email.com", "c@email.com"} {
+		if _, _, _, err := s.CreateUser(email, "user", store.User_PERSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.RotateCA(); err != nil {
+		t.Fatal(err)
+	}
+
+	var w bytes.Buffer
+	if err := reissueUserCerts(s, out, &w); err == nil {
+		t.Fatal("expected an error for the email that cannot name a file")
+	}
+
+	if !strings.Contains(w.String(), `invalid email "../b@email.com"`) {
+		t.Fatalf("expected the invalid email to be reported, got %q", w.String())
+	}
+
+	for _, f := range []string{
+		filepath.Join(out, "a@email.com.crt.pem"),
+		filepath.Join(out, "c@email.com.crt.pem"),
+	} {
+		if _, err := os.Stat(f); err != nil {
+			t.Fatalf("expected %s to be written: %s", f, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(tmp, "b@email.com.crt.pem")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing written outside %s, got %v", out, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"pypibot/store"
+)
+
+func doIssueToken(args []string) {
+	flags := flag.NewFlagSet("issue-token", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagName := flags.String("name", "", "")
+	flagDays := flags.Int("days", 0, "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage %s issue-token [-name name] [-days days] id\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	token, err := s.IssueToken(
+		userId(s, flags.Arg(0)),
+		*flagName,
+		time.Duration(*flagDays)*24*time.Hour)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("token: %s\nid:    %s\n", token, store.TokenId(token))
+}
+
+func doRevokeToken(args []string) {
+	flags := flag.NewFlagSet("revoke-token", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage %s revoke-token id\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if err := s.RevokeToken(flags.Arg(0)); err != nil {
+		log.Panic(err)
+	}
+}
+
+func doListTokens(args []string) {
+	flags := flag.NewFlagSet("list-tokens", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flags.Parse(args)
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	if err := s.ForEachToken(func(id string, t *store.Token) error {
+		user, err := s.FindUser(t.User)
+		if err != nil {
+			return err
+		}
+
+		expires := "never"
+		if t.Expires != 0 {
+			expires = time.Unix(t.Expires, 0).Format(time.RFC3339)
+		}
+
+		fmt.Printf("%s\t%s\t%s\texpires %s\n", id, user.Email, t.Name, expires)
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+}
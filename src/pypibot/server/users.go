@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pypibot/auth"
+	"pypibot/store"
+)
+
+// userRecord is a user as exported by export-users and read by import-users.
+// The key is the hex encoded DER of the user's most recent public key and
+// times are in RFC 3339.
+type userRecord struct {
+	Id      string `json:"id,omitempty"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+	Type    string `json:"type,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Created string `json:"created,omitempty"`
+	Revoked string `json:"revoked,omitempty"`
+	Reason  string `json:"revoke-reason,omitempty"`
+}
+
+// csvColumns are the columns of exported CSV. Imported CSV needs a header
+// row but only the email column; the others may be in any order or missing.
+var csvColumns = []string{"id", "email", "name", "type", "key", "created", "revoked", "revoke-reason"}
+
+func formatTime(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+func newUserRecord(id []byte, user *store.User) *userRecord {
+	r := &userRecord{
+		Id:    hex.EncodeToString(id),
+		Email: user.Email,
+		Name:  user.Name,
+		Type:  user.Type.String(),
+	}
+
+	if len(user.Keys) > 0 {
+		r.Key = hex.EncodeToString(user.Keys[len(user.Keys)-1].Key)
+		r.Created = formatTime(user.Keys[0].Created)
+	}
+
+	if user.IsRevoked() {
+		r.Revoked = formatTime(user.Revocation.Time)
+		r.Reason = user.Revocation.Reason
+	}
+
+	return r
+}
+
+func (r *userRecord) columns() []string {
+	return []string{r.Id, r.Email, r.Name, r.Type, r.Key, r.Created, r.Revoked, r.Reason}
+}
+
+func writeUserRecords(w io.Writer, format string, records []*userRecord) error {
+	switch format {
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(records)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(csvColumns)
+		for _, r := range records {
+			cw.Write(r.columns())
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("invalid format: %s", format)
+}
+
+func readUserRecords(r io.Reader, format string) ([]*userRecord, error) {
+	switch format {
+	case "json":
+		var records []*userRecord
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	case "csv":
+		return readCsvUserRecords(r)
+	}
+	return nil, fmt.Errorf("invalid format: %s", format)
+}
+
+func readCsvUserRecords(r io.Reader) ([]*userRecord, error) {
+	// rows may leave out trailing columns.
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	cols := map[string]int{}
+	for i, c := range rows[0] {
+		cols[strings.ToLower(strings.TrimSpace(c))] = i
+	}
+
+	if _, ok := cols["email"]; !ok {
+		return nil, fmt.Errorf("csv has no email column")
+	}
+
+	var records []*userRecord
+	for _, row := range rows[1:] {
+		get := func(c string) string {
+			if i, ok := cols[c]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		records = append(records, &userRecord{
+			Id:      get("id"),
+			Email:   get("email"),
+			Name:    get("name"),
+			Type:    get("type"),
+			Key:     get("key"),
+			Created: get("created"),
+			Revoked: get("revoked"),
+			Reason:  get("revoke-reason"),
+		})
+	}
+
+	return records, nil
+}
+
+func doExportUsers(args []string) {
+	flags := flag.NewFlagSet("export-users", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagFormat := flags.String("format", "json", "")
+	flagRevoked := flags.Bool("revoked", false, "")
+	flags.Parse(args)
+
+	if flags.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "usage %s export-users [-format json|csv] [-revoked] [file]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	records := []*userRecord{}
+	if err := s.ForEachUser(func(id []byte, user *store.User) error {
+		if !user.IsRevoked() || *flagRevoked {
+			records = append(records, newUserRecord(id, user))
+		}
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	w := os.Stdout
+	if flags.NArg() == 1 {
+		if w, err = os.Create(flags.Arg(0)); err != nil {
+			log.Panic(err)
+		}
+		defer w.Close()
+	}
+
+	if err := writeUserRecords(w, *flagFormat, records); err != nil {
+		log.Panic(err)
+	}
+}
+
+// checkEmailFilename returns an error if email cannot name the files a
+// user's cert and key are written to, since they would land outside their
+// directory.
+func checkEmailFilename(email string) error {
+	if email == "" || strings.ContainsAny(email, `/\`) {
+		return fmt.Errorf("invalid email %q", email)
+	}
+	return nil
+}
+
+// checkUserRecord returns the type of the user to create for r and the key
+// the user is to keep, if r has one, or an error describing why it cannot be
+// imported.
+func checkUserRecord(s *store.Store, r *userRecord, seen map[string]bool) (store.User_UserType, []byte, error) {
+	if err := checkEmailFilename(r.Email); err != nil {
+		return 0, nil, err
+	}
+
+	email := strings.ToLower(r.Email)
+	if seen[email] {
+		return 0, nil, fmt.Errorf("email appears more than once")
+	}
+	seen[email] = true
+
+	t := store.User_PERSON
+	if r.Type != "" {
+		var err error
+		if t, err = stringToUserType(r.Type); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if r.Revoked != "" {
+		return 0, nil, fmt.Errorf("user is revoked")
+	}
+
+	var pub []byte
+	if r.Key != "" {
+		var err error
+		if pub, err = hex.DecodeString(r.Key); err != nil {
+			return 0, nil, fmt.Errorf("invalid key: %s", err)
+		}
+
+		if _, err := x509.ParsePKIXPublicKey(pub); err != nil {
+			return 0, nil, fmt.Errorf("invalid key: %s", err)
+		}
+
+		if _, _, err := s.FindUserByKey(pub); err == nil || err == store.ErrKeyExpired {
+			return 0, nil, fmt.Errorf("key is already in use")
+		} else if err != store.ErrNoUser {
+			return 0, nil, err
+		}
+	}
+
+	if _, _, err := s.FindUserByEmail(r.Email); err == nil {
+		return 0, nil, store.ErrEmailInUse
+	} else if err != store.ErrNoUser {
+		return 0, nil, err
+	}
+
+	return t, pub, nil
+}
+
+// userImporter creates users from records.
+type userImporter struct {
+	s *store.Store
+
+	// kt is the type of the keys generated for records without a key.
+	kt auth.KeyType
+
+	// out is the directory that certs, and generated keys encrypted with p
+	// if it is not nil, are written to.
+	out string
+	p   auth.Passphrase
+
+	// dryRun reports what would be created without creating anything.
+	dryRun bool
+
+	// w is where each record's outcome is reported.
+	w io.Writer
+}
+
+// importUsers creates a user for each record and returns the number of
+// records that could not be imported. A record with a key keeps it, so only
+// a cert is written for it; a record without one is given a new key.
+func (im *userImporter) importUsers(records []*userRecord) (int, error) {
+	conflicts := 0
+	seen := map[string]bool{}
+
+	for _, r := range records {
+		t, pub, err := checkUserRecord(im.s, r, seen)
+		if err != nil {
+			fmt.Fprintf(im.w, "conflict: %s: %s\n", r.Email, err)
+			conflicts++
+			continue
+		}
+
+		if im.dryRun {
+			if pub != nil {
+				fmt.Fprintf(im.w, "would create %s %s %s with its key\n", r.Email, r.Name, t)
+			} else {
+				fmt.Fprintf(im.w, "would create %s %s %s\n", r.Email, r.Name, t)
+			}
+			continue
+		}
+
+		crtFile := filepath.Join(im.out, r.Email+".crt.pem")
+
+		var user *store.User
+		if pub != nil {
+			var crtPem *pem.Block
+			user, crtPem, err = im.s.CreateUserWithPublicKey(r.Email, r.Name, t, pub)
+			if err == nil {
+				err = auth.WritePem(crtPem, crtFile)
+			}
+		} else {
+			var crtPem, keyPem *pem.Block
+			user, crtPem, keyPem, err = im.s.CreateUserWithKeyType(r.Email, r.Name, t, im.kt)
+			if err == nil {
+				err = writeCrtAndKey(
+					crtPem,
+					crtFile,
+					keyPem,
+					filepath.Join(im.out, r.Email+".key.pem"),
+					im.p)
+			}
+		}
+
+		if err == store.ErrEmailInUse {
+			fmt.Fprintf(im.w, "conflict: %s: %s\n", r.Email, err)
+			conflicts++
+			continue
+		} else if err != nil {
+			return conflicts, err
+		}
+
+		fmt.Fprintf(im.w, "created %s %s\n", r.Email, hex.EncodeToString(user.Id))
+	}
+
+	return conflicts, nil
+}
+
+// doImportUsers creates a user for each record in a file. A record with a
+// key, as exported by export-users, keeps it and only its cert is written to
+// the output directory; the others are given new keys, which are written
+// along with their certs. Files are named after the user's email. Records
+// that cannot be imported are reported and skipped, and with -dry-run
+// nothing is created.
+func doImportUsers(args []string) {
+	flags := flag.NewFlagSet("import-users", flag.PanicOnError)
+	flagDbPath := flags.String("dbpath", "data", "")
+	flagFormat := flags.String("format", "json", "")
+	flagOut := flags.String("out", "", "")
+	flagKeyType := flags.String("keyType", "", "")
+	flagDryRun := flags.Bool("dry-run", false, "")
+	flagEncrypt := flags.String("encrypt", "", "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (*flagOut == "" && !*flagDryRun) {
+		fmt.Fprintf(os.Stderr, "usage %s import-users [-format json|csv] [-keyType type] [-encrypt source] (-out dir | -dry-run) file\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	records, err := readUserRecords(f, *flagFormat)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	s, err := store.Open(*flagDbPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer s.Close()
+
+	im := &userImporter{
+		s:      s,
+		out:    *flagOut,
+		dryRun: *flagDryRun,
+		w:      os.Stdout,
+	}
+
+	if im.kt, err = s.Config.KeyType(); err != nil {
+		log.Panic(err)
+	}
+
+	if *flagKeyType != "" {
+		if im.kt, err = auth.ParseKeyType(*flagKeyType); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if !*flagDryRun {
+		if err := os.MkdirAll(*flagOut, 0700); err != nil {
+			log.Panic(err)
+		}
+		im.p = encryptPassphrase(*flagEncrypt)
+	}
+
+	conflicts, err := im.importUsers(records)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if conflicts > 0 {
+		fmt.Printf("%d of %d users not imported\n", conflicts, len(records))
+		s.Close()
+		os.Exit(1)
+	}
+}
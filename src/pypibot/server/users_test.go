@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"pypibot/auth"
+	"pypibot/store"
+)
+
+func TestUserRecordsRoundTrip(t *testing.T) {
+	records := []*userRecord{
+		{
+			Id:      "0102",
+			Email:   "foo@email.com",
+			Name:    "foo, jr.",
+			Type:    "PERSON",
+			Key:     "3059",
+			Created: "2020-01-02T03:04:05Z",
+		},
+		{
+			Id:      "0304",
+			Email:   "bot@email.com",
+			Name:    "bot",
+			Type:    "BOT",
+			Created: "2020-01-02T03:04:05Z",
+			Revoked: "2021-01-02T03:04:05Z",
+			Reason:  "said \"hi\"",
+		},
+	}
+
+	for _, format := range []string{"json", "csv"} {
+		var b bytes.Buffer
+		if err := writeUserRecords(&b, format, records); err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := readUserRecords(&b, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(read, records) {
+			t.Fatalf("%s: expected %v, got %v", format, records, read)
+		}
+	}
+
+	if err := writeUserRecords(ioutil.Discard, "xml", records); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestCsvHeaderMapping(t *testing.T) {
+	records, err := readUserRecords(strings.NewReader(
+		" Name ,EMAIL,notes\nfoo,foo@email.com,ignored\nbar, bar@email.com \n"), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*userRecord{
+		{Email: "foo@email.com", Name: "foo"},
+		{Email: "bar@email.com", Name: "bar"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("expected %v, got %v", expected, records)
+	}
+
+	if _, err := readUserRecords(strings.NewReader("name,id\nfoo,01\n"), "csv"); err == nil {
+		t.Fatal("expected an error for csv without an email column")
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := filepath.Join(tmp, "data")
+	out := filepath.Join(tmp, "out")
+
+	if err := store.Create(data, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	existing, _, _, err := s.CreateUser("old@email.com", "old", store.User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prv, err := auth.GenerateKey(auth.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := auth.GetPublicKey(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*userRecord{
+		{Email: "new@email.com", Name: "new", Type: "bot"},
+		{Email: "kept@email.com", Name: "kept", Key: hex.EncodeToString(pub)},
+		{Email: "OLD@email.com", Name: "old"},
+		{Email: "new@email.com", Name: "again"},
+		{Email: "gone@email.com", Name: "gone", Revoked: "2021-01-02T03:04:05Z"},
+		{Email: "bad@email.com", Name: "bad", Key: "zz"},
+		{Email: "taken@email.com", Name: "taken", Key: hex.EncodeToString(existing.Keys[0].Key)},
+		{Email: "", Name: "nobody"},
+	}
+
+	var w bytes.Buffer
+	im := &userImporter{
+		s:      s,
+		kt:     auth.ECDSA,
+		out:    out,
+		dryRun: true,
+		w:      &w,
+	}
+
+	conflicts, err := im.importUsers(records)
+	if err != nil {
+		t.Fatal(err)
+	} else if conflicts != 6 {
+		t.Fatalf("expected 6 conflicts, got %d:\n%s", conflicts, w.String())
+	}
+
+	expected := `would create new@email.com new BOT
+would create kept@email.com kept PERSON with its key
+conflict: OLD@email.com: email is already in use
+conflict: new@email.com: email appears more than once
+conflict: gone@email.com: user is revoked
+conflict: bad@email.com: invalid key: encoding/hex: invalid byte: U+007A 'z'
+conflict: taken@email.com: key is already in use
+conflict: : invalid email ""
+`
+	if w.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, w.String())
+	}
+
+	if _, _, err := s.FindUserByEmail("new@email.com"); err != store.ErrNoUser {
+		t.Fatalf("expected a dry run to create nothing, got %v", err)
+	}
+
+	w.Reset()
+	im.dryRun = false
+	if err := os.MkdirAll(out, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if conflicts, err := im.importUsers(records); err != nil {
+		t.Fatal(err)
+	} else if conflicts != 6 {
+		t.Fatalf("expected 6 conflicts, got %d:\n%s", conflicts, w.String())
+	}
+
+	if _, user, err := s.FindUserByKey(pub); err != nil {
+		t.Fatal(err)
+	} else if user.Email != "kept@email.com" {
+		t.Fatalf("expected the key to be kept by kept@email.com, got %s", user.Email)
+	}
+
+	if _, user, err := s.FindUserByEmail("new@email.com"); err != nil {
+		t.Fatal(err)
+	} else if user.Type != store.User_BOT {
+		t.Fatalf("expected a bot, got %s", user.Type)
+	}
+
+	for _, test := range []struct {
+		file   string
+		exists bool
+	}{
+		{"new@email.com.crt.pem", true},
+		{"new@email.com.key.pem", true},
+		{"kept@email.com.crt.pem", true},
+		{"kept@email.com.key.pem", false},
+		{"old@email.com.crt.pem", false},
+	} {
+		if _, err := os.Stat(filepath.Join(out, test.file)); (err == nil) != test.exists {
+			t.Fatalf("%s: expected exists to be %v, got %v", test.file, test.exists, err)
+		}
+	}
+}
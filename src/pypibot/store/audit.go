@@ -0,0 +1,406 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The audit log is kept in user.db, keyed by sequence number, so that
+// changes to users are written in the same batch as their entries.
+var auditPrefix = []byte("audit:")
+
+// auditHeadFile, alongside user.db, records the sequence number and digest
+// of the last entry of the audit log. The chain shows entries altered or
+// removed within the log but not those removed from its end, which
+// VerifyAudit finds by comparing the log with this file.
+const auditHeadFile = "audit.head"
+
+// Audit events.
+const (
+	AuditLogin        = "login"
+	AuditAuthFailure  = "auth-failure"
+	AuditUserCreated  = "user-created"
+	AuditUserInvited  = "user-invited"
+	AuditUserEnrolled = "user-enrolled"
+	AuditUserUpdated  = "user-updated"
+	AuditUserRevoked  = "user-revoked"
+	AuditKeyRotated   = "key-rotated"
+	AuditCertIssued   = "cert-issued"
+	AuditBackup       = "backup"
+	AuditRestored     = "restored"
+	AuditRpc          = "rpc"
+	AuditApi          = "api"
+
+	AuditTokenIssued  = "token-issued"
+	AuditTokenRevoked = "token-revoked"
+
+	AuditGroupCreated       = "group-created"
+	AuditGroupDeleted       = "group-deleted"
+	AuditGroupMemberAdded   = "group-member-added"
+	AuditGroupMemberRemoved = "group-member-removed"
+	AuditGrantAdded         = "grant-added"
+	AuditGrantRemoved       = "grant-removed"
+
+	AuditCARotated          = "ca-rotated"
+	AuditCARotationFinished = "ca-rotation-finished"
+	AuditServerCertIssued   = "server-cert-issued"
+)
+
+func auditKey(seq uint64) []byte {
+	k := append([]byte{}, auditPrefix...)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	return append(k, b[:]...)
+}
+
+// auditDigest returns the digest with which the entry following the one
+// encoded as val is chained to it.
+func auditDigest(val []byte) []byte {
+	h := sha256.Sum256(val)
+	return h[:]
+}
+
+// readAuditHeadFile returns the sequence number and digest recorded in the
+// head file of the store at path.
+func readAuditHeadFile(path string) (uint64, []byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(path, auditHeadFile))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) != 1 && len(fields) != 2 {
+		return 0, nil, fmt.Errorf("invalid %s", auditHeadFile)
+	}
+
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid %s: %s", auditHeadFile, err)
+	}
+
+	var digest []byte
+	if len(fields) == 2 {
+		if digest, err = hex.DecodeString(fields[1]); err != nil {
+			return 0, nil, fmt.Errorf("invalid %s: %s", auditHeadFile, err)
+		}
+	}
+
+	return seq, digest, nil
+}
+
+// writeAuditHeadFile records seq and digest in the head file of the store at
+// path. The file is replaced by renaming so that it is never partly written.
+func writeAuditHeadFile(path string, seq uint64, digest []byte) error {
+	tmp := filepath.Join(path, auditHeadFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(f, "%d %x\n", seq, digest); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(path, auditHeadFile))
+}
+
+// lastAuditEntry returns the sequence number and digest of the last entry of
+// the audit log, or zero and nil if it is empty.
+func (s *Store) lastAuditEntry() (uint64, []byte, error) {
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(util.BytesPrefix(auditPrefix), &ro)
+	defer it.Release()
+
+	if !it.Last() {
+		return 0, nil, it.Error()
+	}
+
+	var e AuditEntry
+	if err := proto.Unmarshal(it.Value(), &e); err != nil {
+		return 0, nil, err
+	}
+
+	return e.Seq, auditDigest(it.Value()), nil
+}
+
+// auditHeadMatches reports whether the entry recorded in the head file is
+// in the log, as it is unless the log has lost its end.
+func (s *Store) auditHeadMatches() bool {
+	seq, digest, err := readAuditHeadFile(s.path)
+	if err != nil {
+		return false
+	} else if seq == 0 {
+		return true
+	}
+
+	var ro opt.ReadOptions
+	val, err := s.db.Get(auditKey(seq), &ro)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(auditDigest(val), digest)
+}
+
+// loadAuditHead finds the last entry of the audit log so that new entries
+// can be chained to it. If the log does not agree with the head file, the
+// file is no longer updated, so that VerifyAudit still shows what was lost.
+func (s *Store) loadAuditHead() error {
+	seq, digest, err := s.lastAuditEntry()
+	if err != nil {
+		return err
+	}
+
+	s.auditSeq = seq
+	s.auditHead = digest
+	s.auditHeadStale = !s.auditHeadMatches()
+	return nil
+}
+
+// writeAudited writes b along with the audit entry e, chained to the last
+// entry, in a single batch.
+func (s *Store) writeAudited(b *leveldb.Batch, e *AuditEntry) error {
+	s.alck.Lock()
+	defer s.alck.Unlock()
+
+	e.Seq = s.auditSeq + 1
+	e.Time = time.Now().UnixNano()
+	e.Prev = s.auditHead
+
+	val, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b.Put(auditKey(e.Seq), val)
+
+	if err := s.db.Write(b, &opt.WriteOptions{
+		Sync: true,
+	}); err != nil {
+		return err
+	}
+
+	s.auditSeq = e.Seq
+	s.auditHead = auditDigest(val)
+
+	if s.auditHeadStale {
+		return nil
+	}
+
+	if err := writeAuditHeadFile(s.path, e.Seq, s.auditHead); err != nil {
+		return fmt.Errorf("audit entry %d was written but not recorded in %s: %s", e.Seq, auditHeadFile, err)
+	}
+	return nil
+}
+
+// Audit appends e to the audit log. Its sequence number, time and chain
+// digest are filled in.
+func (s *Store) Audit(e *AuditEntry) error {
+	var b leveldb.Batch
+	return s.writeAudited(&b, e)
+}
+
+// Only the first failure to authenticate from a host within
+// authFailureWindow is audited. Later ones are counted and the count is
+// recorded with the next failure that is audited, so that peers cannot fill
+// the audit log, and its synced writes, at will.
+const (
+	authFailureWindow = time.Minute
+
+	// maxAuthFailureHosts bounds the hosts tracked at once. Failures from
+	// hosts beyond it are counted together.
+	maxAuthFailureHosts = 1024
+)
+
+// authFailures are the failures to authenticate seen from a host.
+type authFailures struct {
+	since      time.Time
+	suppressed int
+}
+
+// throttleAuthFailure reports whether a failure to authenticate from host at
+// now is to be audited and, if so, how many failures from the host since the
+// last one audited were not.
+func (s *Store) throttleAuthFailure(host string, now time.Time) (int, bool) {
+	s.flck.Lock()
+	defer s.flck.Unlock()
+
+	if s.authFailures == nil {
+		s.authFailures = map[string]*authFailures{}
+	}
+
+	f, ok := s.authFailures[host]
+	if !ok && len(s.authFailures) >= maxAuthFailureHosts {
+		for h, f := range s.authFailures {
+			if now.Sub(f.since) >= authFailureWindow && f.suppressed == 0 {
+				delete(s.authFailures, h)
+			}
+		}
+
+		if len(s.authFailures) >= maxAuthFailureHosts {
+			host = "other hosts"
+			f, ok = s.authFailures[host]
+		}
+	}
+
+	if ok && now.Sub(f.since) < authFailureWindow {
+		f.suppressed++
+		return 0, false
+	}
+
+	suppressed := 0
+	if ok {
+		suppressed = f.suppressed
+	}
+
+	s.authFailures[host] = &authFailures{
+		since: now,
+	}
+	return suppressed, true
+}
+
+// AuditAuthFailure records that the peer at remoteAddr failed to
+// authenticate, along with the cert it presented, if any. Failures are rate
+// limited per host, see authFailureWindow, so nil is returned without writing
+// anything for most of those from a host that keeps failing.
+func (s *Store) AuditAuthFailure(remoteAddr string, certs []*x509.Certificate, err error) error {
+	host, _, splitErr := net.SplitHostPort(remoteAddr)
+	if splitErr != nil {
+		host = remoteAddr
+	}
+
+	suppressed, ok := s.throttleAuthFailure(host, time.Now())
+	if !ok {
+		return nil
+	}
+
+	detail := err.Error()
+	if len(certs) > 0 {
+		h := sha256.Sum256(certs[0].Raw)
+		detail = fmt.Sprintf("%s: cert %s %x", detail, certs[0].Subject, h)
+	}
+
+	if suppressed > 0 {
+		detail = fmt.Sprintf("%s (%d earlier failures not audited)", detail, suppressed)
+	}
+
+	return s.Audit(&AuditEntry{
+		Event:      AuditAuthFailure,
+		RemoteAddr: remoteAddr,
+		Detail:     detail,
+	})
+}
+
+// ForEachAuditEntry calls f for each entry of the audit log with a sequence
+// number greater than after, in order.
+func (s *Store) ForEachAuditEntry(after uint64, f func(*AuditEntry) error) error {
+	r := util.BytesPrefix(auditPrefix)
+	r.Start = auditKey(after + 1)
+
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(r, &ro)
+	defer it.Release()
+
+	for it.Next() {
+		var e AuditEntry
+		if err := proto.Unmarshal(it.Value(), &e); err != nil {
+			return err
+		}
+
+		if err := f(&e); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+// VerifyAudit checks that every entry of the audit log is chained to the one
+// before it, that none are missing and that the log ends with the entry
+// recorded in the head file. It returns the number of entries and the digest
+// of the last one, which can be recorded elsewhere to detect the rewriting of
+// the whole log along with the head file. Problems are described in the
+// error.
+func (s *Store) VerifyAudit() (uint64, string, error) {
+	var problems []string
+
+	headSeq, headDigest, err := readAuditHeadFile(s.path)
+	if os.IsNotExist(err) {
+		problems = append(problems, fmt.Sprintf("%s is missing", auditHeadFile))
+	} else if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(util.BytesPrefix(auditPrefix), &ro)
+	defer it.Release()
+
+	var n uint64
+	var prev []byte
+
+	for it.Next() {
+		n++
+
+		var e AuditEntry
+		if err := proto.Unmarshal(it.Value(), &e); err != nil {
+			problems = append(problems, fmt.Sprintf("entry %d is corrupt: %s", n, err))
+		} else if !bytes.Equal(it.Key(), auditKey(e.Seq)) || e.Seq != n {
+			problems = append(problems, fmt.Sprintf("entry %d is out of sequence: %d", n, e.Seq))
+			n = e.Seq
+		} else if !bytes.Equal(e.Prev, prev) {
+			problems = append(problems, fmt.Sprintf("entry %d does not follow entry %d", n, n-1))
+		}
+
+		prev = auditDigest(it.Value())
+
+		if n == headSeq && !bytes.Equal(prev, headDigest) {
+			problems = append(problems, fmt.Sprintf("entry %d differs from the one in %s", n, auditHeadFile))
+		}
+	}
+
+	if err := it.Error(); err != nil {
+		return 0, "", err
+	}
+
+	// the head file is written after the entry, so it may lag by one
+	// after a crash, but the log never ends before it.
+	if n < headSeq {
+		problems = append(problems, fmt.Sprintf("the log ends at entry %d but %s records entry %d",
+			n, auditHeadFile, headSeq))
+	} else if err == nil && n > headSeq+1 {
+		problems = append(problems, fmt.Sprintf("%s records entry %d, %d behind the log",
+			auditHeadFile, headSeq, n-headSeq))
+	}
+
+	if len(problems) > 0 {
+		return n, "", fmt.Errorf("audit log has been tampered with: %s",
+			strings.Join(problems, "; "))
+	}
+
+	return n, hex.EncodeToString(prev), nil
+}
@@ -0,0 +1,399 @@
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// A backup is a gzipped tar archive holding, in order, the manifest, the
+// config and PEM files of the store and a dump of every record in user.db.
+// Each record in the dump is its key and then its value, both preceded by
+// their length as a uvarint.
+const (
+	manifestFile = "MANIFEST"
+	dumpFile     = "user.dump"
+)
+
+// backupFiles are the files of a store, other than user.db, that are backed
+// up if they exist. The first five are required to restore a store.
+var backupFiles = []string{
+	configFilePath,
+	caCrtFile,
+	caKeyFile,
+	srvCrtFile,
+	srvKeyFile,
+	oldCACrtFile,
+	oldCAKeyFile,
+	newCACrtFile,
+	newCAKeyFile,
+	crossCrtFile,
+}
+
+const requiredBackupFiles = 5
+
+// dumpSnapshot writes every record in the snapshot to w, returning the number
+// of records.
+func dumpSnapshot(snap *leveldb.Snapshot, w io.Writer) (uint64, error) {
+	var ro opt.ReadOptions
+	it := snap.NewIterator(nil, &ro)
+	defer it.Release()
+
+	var n uint64
+	var b [binary.MaxVarintLen64]byte
+	for it.Next() {
+		for _, v := range [][]byte{it.Key(), it.Value()} {
+			if _, err := w.Write(b[:binary.PutUvarint(b[:], uint64(len(v)))]); err != nil {
+				return 0, err
+			}
+			if _, err := w.Write(v); err != nil {
+				return 0, err
+			}
+		}
+		n++
+	}
+
+	return n, it.Error()
+}
+
+// countingWriter counts the bytes written to it and hashes them.
+type countingWriter struct {
+	n int64
+	h hash.Hash
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return w.h.Write(b)
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(b)
+	return err
+}
+
+// Backup writes an archive of the store to w from a consistent snapshot of
+// user.db, so the store may be in use while it is made. The archive holds the
+// CA and server keys and must be kept as safe as the store itself.
+func (s *Store) Backup(w io.Writer) error {
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	v, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	// the snapshot is dumped twice, first to find the size and digest of
+	// the dump, which the tar header and manifest need before the dump
+	// itself.
+	cw := &countingWriter{
+		h: sha256.New(),
+	}
+	records, err := dumpSnapshot(snap, cw)
+	if err != nil {
+		return err
+	}
+
+	m := &BackupManifest{
+		Created:       time.Now().Unix(),
+		SchemaVersion: v,
+		Records:       records,
+		Digest:        cw.h.Sum(nil),
+	}
+
+	files := map[string][]byte{}
+	for _, f := range backupFiles {
+		b, err := ioutil.ReadFile(filepath.Join(s.path, f))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		files[f] = b
+		m.Files = append(m.Files, f)
+	}
+
+	val, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+
+	if err := writeTarFile(tw, manifestFile, val); err != nil {
+		return err
+	}
+
+	for _, f := range m.Files {
+		if err := writeTarFile(tw, f, files[f]); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    dumpFile,
+		Mode:    0600,
+		Size:    cw.n,
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := dumpSnapshot(snap, tw); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// readDump writes the records of a dump of size bytes to db in batches. No
+// record may claim more bytes than are left, so that a corrupt length cannot
+// make it allocate more than the dump holds.
+func readDump(r *bufio.Reader, size int64, db *leveldb.DB) (uint64, error) {
+	var n uint64
+	var b leveldb.Batch
+
+	left := size
+	read := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf [binary.MaxVarintLen64]byte
+		left -= int64(binary.PutUvarint(buf[:], l))
+		if left < 0 || l > uint64(left) {
+			return nil, fmt.Errorf("record of %d bytes", l)
+		}
+		left -= int64(l)
+
+		v := make([]byte, l)
+		if _, err := io.ReadFull(r, v); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return v, nil
+	}
+
+	for {
+		k, err := read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("corrupt dump: %s", err)
+		}
+
+		v, err := read()
+		if err != nil {
+			return 0, fmt.Errorf("corrupt dump: %s", err)
+		}
+
+		b.Put(k, v)
+		n++
+
+		if b.Len() >= 1000 {
+			if err := db.Write(&b, nil); err != nil {
+				return 0, err
+			}
+			b.Reset()
+		}
+	}
+
+	return n, db.Write(&b, &opt.WriteOptions{
+		Sync: true,
+	})
+}
+
+// restoreInto unpacks the archive in r into the empty directory dir and
+// returns its manifest.
+func restoreInto(r io.Reader, dir string) (*BackupManifest, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	} else if hdr.Name != manifestFile {
+		return nil, errors.New("archive does not begin with a manifest")
+	}
+
+	val, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	var m BackupManifest
+	if err := proto.Unmarshal(val, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", err)
+	}
+
+	if m.SchemaVersion > schemaVersion {
+		return nil, fmt.Errorf("backup is at version %d, newer than the supported %d",
+			m.SchemaVersion, schemaVersion)
+	}
+
+	known := map[string]bool{}
+	for _, f := range backupFiles {
+		known[f] = true
+	}
+
+	found := map[string]bool{}
+	for _, f := range m.Files {
+		if !known[f] || found[f] {
+			return nil, fmt.Errorf("unexpected file in backup: %q", f)
+		}
+		found[f] = true
+	}
+
+	for _, f := range backupFiles[:requiredBackupFiles] {
+		if !found[f] {
+			return nil, fmt.Errorf("backup lacks %s", f)
+		}
+	}
+
+	for _, f := range m.Files {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil, err
+		} else if hdr.Name != f {
+			return nil, fmt.Errorf("expected %s in archive, found %s", f, hdr.Name)
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		// anything other than the config must be a PEM.
+		if f != configFilePath {
+			if p, _ := pem.Decode(b); p == nil {
+				return nil, fmt.Errorf("%s is not a valid PEM", f)
+			}
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, f), b, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	if hdr, err = tr.Next(); err != nil {
+		return nil, err
+	} else if hdr.Name != dumpFile {
+		return nil, fmt.Errorf("expected %s in archive, found %s", dumpFile, hdr.Name)
+	}
+
+	db, err := leveldb.OpenFile(filepath.Join(dir, userFilePath), &opt.Options{})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	h := sha256.New()
+	n, err := readDump(bufio.NewReader(io.TeeReader(tr, h)), hdr.Size, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if n != m.Records || !bytes.Equal(h.Sum(nil), m.Digest) {
+		return nil, errors.New("dump does not match the manifest")
+	}
+
+	if _, err := tr.Next(); err != io.EOF {
+		return nil, errors.New("unexpected data after the dump")
+	}
+
+	// the head file is not backed up, since the log in the dump is what
+	// is restored.
+	seq, digest, err := (&Store{db: timedDB{db}}).lastAuditEntry()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeAuditHeadFile(dir, seq, digest); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Restore recreates the store in the archive made by Backup at path, which
+// must not exist. The archive is checked against its manifest and the
+// restored store is opened, which brings it up to the current schema, before
+// it is moved into place.
+func Restore(r io.Reader, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists.", path)
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(path), filepath.Base(path)+".restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	m, err := restoreInto(r, tmp)
+	if err != nil {
+		return err
+	}
+
+	s, err := Open(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.ServerTlsConfig(); err != nil {
+		s.Close()
+		return err
+	}
+
+	if err := s.Audit(&AuditEntry{
+		Event: AuditRestored,
+		Detail: fmt.Sprintf("backup of %s, %d records, digest %x",
+			time.Unix(m.Created, 0).UTC().Format(time.RFC3339), m.Records, m.Digest),
+	}); err != nil {
+		s.Close()
+		return err
+	}
+
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
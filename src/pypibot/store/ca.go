@@ -0,0 +1,359 @@
+package store
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+
+	"pypibot/auth"
+)
+
+const (
+	newCACrtFile = "ca.new.crt.pem"
+	newCAKeyFile = "ca.new.key.pem"
+
+	oldCACrtFile = "ca.old.crt.pem"
+	oldCAKeyFile = "ca.old.key.pem"
+
+	crossCrtFile = "ca.cross.crt.pem"
+)
+
+// CAStatus describes the progress of a CA rotation.
+type CAStatus struct {
+	// Rotating indicates that a new CA has been created and is issuing
+	// client certs, but the rotation has not yet been finished.
+	Rotating bool
+
+	// Current is the number of users with an active cert issued by the CA
+	// that is currently issuing certs.
+	Current int
+
+	// Old is the number of users whose active certs were all issued by
+	// some other CA.
+	Old int
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func (s *Store) isRotatingCA() bool {
+	return fileExists(filepath.Join(s.path, newCACrtFile))
+}
+
+// issuerPems returns the cert and key of the CA that signs new client certs.
+// During a CA rotation this is the new CA.
+func (s *Store) issuerPems() (*pem.Block, *pem.Block, error) {
+	if s.isRotatingCA() {
+		return auth.ReadBothPems(
+			filepath.Join(s.path, newCACrtFile),
+			filepath.Join(s.path, newCAKeyFile))
+	}
+
+	return auth.ReadBothPems(
+		filepath.Join(s.path, caCrtFile),
+		filepath.Join(s.path, caKeyFile))
+}
+
+// CheckCAKey reads the key of the CA that signs new client certs, so that
+// the passphrase of an encrypted key is asked for, and checked, up front
+// rather than when the first cert is issued.
+func (s *Store) CheckCAKey() error {
+	_, keyPem, err := s.issuerPems()
+	if err != nil {
+		return err
+	}
+
+	_, err = auth.ParsePrivateKey(keyPem)
+	return err
+}
+
+// trustedCAPems returns the certs of all CAs whose client certs are accepted.
+func (s *Store) trustedCAPems() ([]*pem.Block, error) {
+	caCrtPem, err := auth.ReadPem(filepath.Join(s.path, caCrtFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.isRotatingCA() {
+		return []*pem.Block{caCrtPem}, nil
+	}
+
+	newCrtPem, err := auth.ReadPem(filepath.Join(s.path, newCACrtFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return []*pem.Block{caCrtPem, newCrtPem}, nil
+}
+
+// RotateCA creates a new CA that issues all client certs from now on. Client
+// certs issued by either the existing or the new CA are accepted until
+// FinishCARotation is called.
+func (s *Store) RotateCA() error {
+	if s.isRotatingCA() {
+		return errors.New("a CA rotation is already in progress")
+	}
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(s.path, caCrtFile))
+	if err != nil {
+		return err
+	}
+
+	// keys issued before issuers were recorded were necessarily issued by
+	// the CA, so record that before it stops being the issuer.
+	fp := auth.Fingerprint(caCrtPem)
+	if err := s.updateUsers(fmt.Sprintf("issuer %x recorded", fp), func(id []byte, user *User) bool {
+		changed := false
+		for _, k := range user.Keys {
+			if len(k.Issuer) == 0 {
+				k.Issuer = fp
+				changed = true
+			}
+		}
+		return changed
+	}); err != nil {
+		return err
+	}
+
+	kt, err := s.Config.KeyType()
+	if err != nil {
+		return err
+	}
+
+	crtPem, keyPem, err := auth.GenerateCACert(kt)
+	if err != nil {
+		return err
+	}
+
+	// the new CA's key is encrypted, with the same passphrase, if the
+	// current one is. Reading the current key checks the passphrase.
+	var p auth.Passphrase
+	if enc, err := auth.IsEncryptedFile(filepath.Join(s.path, caKeyFile)); err != nil {
+		return err
+	} else if enc {
+		if _, err := auth.ReadPem(filepath.Join(s.path, caKeyFile)); err != nil {
+			return err
+		}
+		p = auth.KeyPassphrase
+	}
+
+	if err := auth.WritePem(crtPem, filepath.Join(s.path, newCACrtFile)); err != nil {
+		return err
+	}
+
+	if err := auth.WriteKeyPem(keyPem, filepath.Join(s.path, newCAKeyFile), p); err != nil {
+		return err
+	}
+
+	return s.Audit(&AuditEntry{
+		Event:  AuditCARotated,
+		Detail: fmt.Sprintf("new ca %x", auth.Fingerprint(crtPem)),
+	})
+}
+
+// FinishCARotation makes the new CA the store's CA and issues a new server
+// cert from it. Client certs issued by the previous CA are no longer
+// accepted. The previous CA is kept in ca.old.crt.pem and ca.old.key.pem and
+// the new CA is cross-signed by it so that clients that have yet to trust
+// the new CA can still verify the server.
+func (s *Store) FinishCARotation() error {
+	if !s.isRotatingCA() {
+		return errors.New("no CA rotation is in progress")
+	}
+
+	caCrtPem, caKeyPem, err := auth.ReadBothPems(
+		filepath.Join(s.path, caCrtFile),
+		filepath.Join(s.path, caKeyFile))
+	if err != nil {
+		return err
+	}
+
+	newCrtPem, err := auth.ReadPem(filepath.Join(s.path, newCACrtFile))
+	if err != nil {
+		return err
+	}
+
+	crossPem, err := auth.CrossSignCACert(newCrtPem, caCrtPem, caKeyPem)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range [][2]string{
+		{caCrtFile, oldCACrtFile},
+		{caKeyFile, oldCAKeyFile},
+		{newCACrtFile, caCrtFile},
+		{newCAKeyFile, caKeyFile},
+	} {
+		if err := os.Rename(
+			filepath.Join(s.path, f[0]),
+			filepath.Join(s.path, f[1])); err != nil {
+			return err
+		}
+	}
+
+	if err := auth.WritePem(crossPem, filepath.Join(s.path, crossCrtFile)); err != nil {
+		return err
+	}
+
+	if err := writeServerCert(s.path, s.Config); err != nil {
+		return err
+	}
+
+	return s.Audit(&AuditEntry{
+		Event:  AuditCARotationFinished,
+		Detail: fmt.Sprintf("ca %x", auth.Fingerprint(newCrtPem)),
+	})
+}
+
+// ReissueUserCert issues a new cert from the current issuing CA for the
+// user's most recent key. Since the key itself does not change, the user's
+// existing private key remains valid with the new cert.
+func (s *Store) ReissueUserCert(id []byte) (*pem.Block, error) {
+	user, err := s.FindUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.IsRevoked() {
+		return nil, errors.New("user is revoked")
+	}
+
+	if len(user.Keys) == 0 {
+		return nil, fmt.Errorf("user %s has no key", user.Email)
+	}
+	key := user.Keys[len(user.Keys)-1]
+
+	pub, err := x509.ParsePKIXPublicKey(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	caCrtPem, caKeyPem, err := s.issuerPems()
+	if err != nil {
+		return nil, err
+	}
+
+	crtPem, err := auth.IssueClientCert(
+		pub,
+		caCrtPem,
+		caKeyPem,
+		s.Config.ClientCertLifetime())
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := auth.Fingerprint(caCrtPem)
+
+	if _, err := s.mutateUser(id, &AuditEntry{
+		Event:  AuditCertIssued,
+		Detail: fmt.Sprintf("issuer %x", issuer),
+	}, func(user *User) error {
+		// the user may have been changed while the cert was issued.
+		if user.IsRevoked() {
+			return errors.New("user is revoked")
+		}
+
+		if len(user.Keys) == 0 {
+			return fmt.Errorf("user %s has no key", user.Email)
+		}
+
+		last := user.Keys[len(user.Keys)-1]
+		if !bytes.Equal(last.Key, key.Key) {
+			return errors.New("user's key was rotated while reissuing")
+		}
+
+		last.Issuer = issuer
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return crtPem, nil
+}
+
+// CAStatus reports how many active users hold certs from the issuing CA.
+func (s *Store) CAStatus() (*CAStatus, error) {
+	caCrtPem, _, err := s.issuerPems()
+	if err != nil {
+		return nil, err
+	}
+
+	curCrtPem, err := auth.ReadPem(filepath.Join(s.path, caCrtFile))
+	if err != nil {
+		return nil, err
+	}
+
+	fp := auth.Fingerprint(caCrtPem)
+	curFp := auth.Fingerprint(curCrtPem)
+
+	status := &CAStatus{
+		Rotating: s.isRotatingCA(),
+	}
+
+	if err := s.ForEachUser(func(id []byte, user *User) error {
+		if user.IsRevoked() {
+			return nil
+		}
+
+		for _, k := range user.Keys {
+			if k.Expires != 0 {
+				continue
+			}
+
+			issuer := k.Issuer
+			if len(issuer) == 0 {
+				issuer = curFp
+			}
+
+			if bytes.Equal(issuer, fp) {
+				status.Current++
+				return nil
+			}
+		}
+
+		status.Old++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// updateUsers calls f for every user and writes back those for which f
+// returns true, auditing each as updated with detail. Since the users are
+// changed one at a time, f is called again with the current copy of each
+// user it changes and must be idempotent.
+func (s *Store) updateUsers(detail string, f func(id []byte, user *User) bool) error {
+	var ids [][]byte
+	if err := s.ForEachUser(func(id []byte, user *User) error {
+		if f(id, proto.Clone(user).(*User)) {
+			ids = append(ids, append([]byte{}, id...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := s.mutateUser(id, &AuditEntry{
+			Event:  AuditUserUpdated,
+			Detail: detail,
+		}, func(user *User) error {
+			f(id, user)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+
+	"pypibot/auth"
+)
+
+const enrollTokenLifetime = 72 * time.Hour
+
+var enrollPrefix = []byte("enroll:")
+
+// ErrInvalidToken is returned when an enrollment token is unknown, has
+// already been used or has expired.
+var ErrInvalidToken = errors.New("invalid enrollment token")
+
+func enrollKey(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return append(append([]byte{}, enrollPrefix...), h[:]...)
+}
+
+// InviteUser creates a pending user and returns a one-time token with which
+// the user can enroll a key of their own through EnrollUser. Only a digest of
+// the token is stored.
+func (s *Store) InviteUser(email, name string, t User_UserType) (string, error) {
+	// the email is checked again when the user enrolls.
+	if err := s.checkEmail(email, nil); err != nil {
+		return "", err
+	}
+
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b[:])
+
+	val, err := proto.Marshal(&Enrollment{
+		User: &User{
+			Email: email,
+			Name:  name,
+			Type:  t,
+		},
+		Expires: time.Now().Add(enrollTokenLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var batch leveldb.Batch
+	batch.Put(enrollKey(token), val)
+
+	if err := s.writeAudited(&batch, &AuditEntry{
+		Event:  AuditUserInvited,
+		Detail: fmt.Sprintf("%s %s %s", email, name, t),
+	}); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// EnrollUser signs the certificate signing request for the pending user
+// associated with token and binds the public key in the request to that
+// user. The token cannot be used again.
+func (s *Store) EnrollUser(token string, csrPem *pem.Block) (*User, *pem.Block, error) {
+	var ro opt.ReadOptions
+
+	// hold the lock so that a token cannot be used by concurrent callers.
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	key := enrollKey(token)
+	val, err := s.db.Get(key, &ro)
+	if err == leveldb.ErrNotFound {
+		return nil, nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var e Enrollment
+	if err := proto.Unmarshal(val, &e); err != nil {
+		return nil, nil, err
+	}
+
+	if time.Now().Unix() > e.Expires {
+		return nil, nil, ErrInvalidToken
+	}
+
+	caCrtPem, caKeyPem, err := s.issuerPems()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crtPem, err := auth.SignCSR(
+		csrPem,
+		caCrtPem,
+		caKeyPem,
+		s.Config.ClientCertLifetime())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crt, err := x509.ParseCertificate(crtPem.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(crt.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if inUse, err := s.keyInUse(pub); err != nil {
+		return nil, nil, err
+	} else if inUse {
+		return nil, nil, errors.New("key is already in use")
+	}
+
+	id, err := newUserId()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := e.User
+	user.Id = id
+	user.Keys = []*Key{
+		{
+			Key:     pub,
+			Created: time.Now().Unix(),
+			Issuer:  auth.Fingerprint(caCrtPem),
+		},
+	}
+
+	if err := s.writeUser(id, user, &AuditEntry{
+		Event:  AuditUserEnrolled,
+		Detail: user.Email,
+	}, func(b *leveldb.Batch) {
+		b.Delete(key)
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return user, crtPem, nil
+}
+
+// CACert returns the cert of the CA that clients use to verify the server.
+func (s *Store) CACert() (*pem.Block, error) {
+	return auth.ReadPem(filepath.Join(s.path, caCrtFile))
+}
@@ -0,0 +1,376 @@
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// AnyAction is the action of a grant that permits every action.
+const AnyAction = "*"
+
+var (
+	groupPrefix = []byte("group:")
+	grantPrefix = []byte("grant:")
+)
+
+// ErrNoGroup is returned when a group does not exist.
+var ErrNoGroup = errors.New("no such group")
+
+func groupKey(name string) []byte {
+	return append(append([]byte{}, groupPrefix...), name...)
+}
+
+// grantee identifies who a grant is for in its key.
+func grantee(g *Grant) string {
+	if g.Group != "" {
+		return "group:" + g.Group
+	}
+	return "user:" + hex.EncodeToString(g.User)
+}
+
+// Grants are keyed by grantee, bot and action so that the grants of a user
+// or group can be found with a prefix scan.
+func grantKey(g *Grant) []byte {
+	return []byte(fmt.Sprintf("%s%s/%x/%s", grantPrefix, grantee(g), g.Bot, g.Action))
+}
+
+func granteePrefix(g *Grant) []byte {
+	return []byte(fmt.Sprintf("%s%s/", grantPrefix, grantee(g)))
+}
+
+func validName(kind, name string) error {
+	if name == "" || strings.ContainsAny(name, "/ \t\n") {
+		return fmt.Errorf("invalid %s name: %q", kind, name)
+	}
+	return nil
+}
+
+// CreateGroup adds an empty group.
+func (s *Store) CreateGroup(name, description string) error {
+	if err := validName("group", name); err != nil {
+		return err
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	var ro opt.ReadOptions
+	if ok, err := s.db.Has(groupKey(name), &ro); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("group %s already exists", name)
+	}
+
+	return s.putGroup(&Group{
+		Name:        name,
+		Description: description,
+	}, &AuditEntry{
+		Event:  AuditGroupCreated,
+		Detail: name,
+	})
+}
+
+// putGroup writes g along with the audit entry e.
+func (s *Store) putGroup(g *Group, e *AuditEntry) error {
+	val, err := proto.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	var b leveldb.Batch
+	b.Put(groupKey(g.Name), val)
+	return s.writeAudited(&b, e)
+}
+
+// FindGroup returns the group with the given name or ErrNoGroup.
+func (s *Store) FindGroup(name string) (*Group, error) {
+	var ro opt.ReadOptions
+	val, err := s.db.Get(groupKey(name), &ro)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNoGroup
+	} else if err != nil {
+		return nil, err
+	}
+
+	var g Group
+	if err := proto.Unmarshal(val, &g); err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+// DeleteGroup removes the group along with the grants made to it.
+func (s *Store) DeleteGroup(name string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if _, err := s.FindGroup(name); err != nil {
+		return err
+	}
+
+	var b leveldb.Batch
+	b.Delete(groupKey(name))
+
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(util.BytesPrefix(granteePrefix(&Grant{Group: name})), &ro)
+	for it.Next() {
+		b.Delete(append([]byte{}, it.Key()...))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	return s.writeAudited(&b, &AuditEntry{
+		Event:  AuditGroupDeleted,
+		Detail: name,
+	})
+}
+
+// AddGroupMember adds the user identified by id to the group.
+func (s *Store) AddGroupMember(name string, id []byte) error {
+	if _, err := s.FindUser(id); err != nil {
+		return err
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	g, err := s.FindGroup(name)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range g.Members {
+		if bytes.Equal(m, id) {
+			return nil
+		}
+	}
+
+	g.Members = append(g.Members, id)
+	return s.putGroup(g, &AuditEntry{
+		Event:   AuditGroupMemberAdded,
+		Subject: id,
+		Detail:  name,
+	})
+}
+
+// RemoveGroupMember removes the user identified by id from the group.
+func (s *Store) RemoveGroupMember(name string, id []byte) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	g, err := s.FindGroup(name)
+	if err != nil {
+		return err
+	}
+
+	for i, m := range g.Members {
+		if bytes.Equal(m, id) {
+			g.Members = append(g.Members[:i], g.Members[i+1:]...)
+			return s.putGroup(g, &AuditEntry{
+				Event:   AuditGroupMemberRemoved,
+				Subject: id,
+				Detail:  name,
+			})
+		}
+	}
+
+	return fmt.Errorf("user is not a member of %s", name)
+}
+
+func (s *Store) ForEachGroup(f func(*Group) error) error {
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(util.BytesPrefix(groupPrefix), &ro)
+	defer it.Release()
+
+	for it.Next() {
+		var g Group
+		if err := proto.Unmarshal(it.Value(), &g); err != nil {
+			return err
+		}
+
+		if err := f(&g); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+// checkGrant verifies that the grantee and bot of g exist.
+func (s *Store) checkGrant(g *Grant) error {
+	if (len(g.User) == 0) == (g.Group == "") {
+		return errors.New("a grant is for either a user or a group")
+	}
+
+	if err := validName("action", g.Action); err != nil {
+		return err
+	}
+
+	if g.Group != "" {
+		if _, err := s.FindGroup(g.Group); err != nil {
+			return err
+		}
+	} else if _, err := s.FindUser(g.User); err != nil {
+		return err
+	}
+
+	if len(g.Bot) != 0 {
+		bot, err := s.FindUser(g.Bot)
+		if err != nil {
+			return err
+		}
+
+		if bot.Type != User_BOT {
+			return fmt.Errorf("%s is not a bot", bot.Email)
+		}
+	}
+
+	return nil
+}
+
+// AddGrant permits the grantee of g to perform its action on its bot.
+func (s *Store) AddGrant(g *Grant) error {
+	if err := s.checkGrant(g); err != nil {
+		return err
+	}
+
+	val, err := proto.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	var b leveldb.Batch
+	b.Put(grantKey(g), val)
+
+	return s.writeAudited(&b, &AuditEntry{
+		Event:   AuditGrantAdded,
+		Subject: g.User,
+		Detail:  describeGrant(g),
+	})
+}
+
+// RemoveGrant removes a grant previously added with AddGrant.
+func (s *Store) RemoveGrant(g *Grant) error {
+	var ro opt.ReadOptions
+	if ok, err := s.db.Has(grantKey(g), &ro); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("no such grant")
+	}
+
+	var b leveldb.Batch
+	b.Delete(grantKey(g))
+
+	return s.writeAudited(&b, &AuditEntry{
+		Event:   AuditGrantRemoved,
+		Subject: g.User,
+		Detail:  describeGrant(g),
+	})
+}
+
+// describeGrant names the grantee, action and bot of g for the audit log.
+func describeGrant(g *Grant) string {
+	bot := "any bot"
+	if len(g.Bot) != 0 {
+		bot = fmt.Sprintf("bot %x", g.Bot)
+	}
+	return fmt.Sprintf("%s %s on %s", grantee(g), g.Action, bot)
+}
+
+func (s *Store) forEachGrantIn(r *util.Range, f func(*Grant) error) error {
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(r, &ro)
+	defer it.Release()
+
+	for it.Next() {
+		var g Grant
+		if err := proto.Unmarshal(it.Value(), &g); err != nil {
+			return err
+		}
+
+		if err := f(&g); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+func (s *Store) ForEachGrant(f func(*Grant) error) error {
+	return s.forEachGrantIn(util.BytesPrefix(grantPrefix), f)
+}
+
+// GroupsOf returns the names of the groups the user identified by id is a
+// member of.
+func (s *Store) GroupsOf(id []byte) ([]string, error) {
+	var names []string
+	if err := s.ForEachGroup(func(g *Group) error {
+		for _, m := range g.Members {
+			if bytes.Equal(m, id) {
+				names = append(names, g.Name)
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Permits indicates whether the user identified by id may perform action on
+// the bot identified by bot, either through a grant to the user or to one of
+// the user's groups. GOD users may do anything and revoked users nothing.
+func (s *Store) Permits(id []byte, action string, bot []byte) (bool, error) {
+	user, err := s.FindUser(id)
+	if err != nil {
+		return false, err
+	}
+
+	if user.IsRevoked() {
+		return false, nil
+	}
+
+	if user.Type == User_GOD {
+		return true, nil
+	}
+
+	groups, err := s.GroupsOf(id)
+	if err != nil {
+		return false, err
+	}
+
+	grantees := []*Grant{{User: id}}
+	for _, name := range groups {
+		grantees = append(grantees, &Grant{Group: name})
+	}
+
+	errFound := errors.New("found")
+	for _, g := range grantees {
+		err := s.forEachGrantIn(util.BytesPrefix(granteePrefix(g)), func(g *Grant) error {
+			if (len(g.Bot) == 0 || bytes.Equal(g.Bot, bot)) &&
+				(g.Action == AnyAction || g.Action == action) {
+				return errFound
+			}
+			return nil
+		})
+		if err == errFound {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
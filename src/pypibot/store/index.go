@@ -0,0 +1,313 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Active users are indexed by email, which is unique among them, and by name,
+// which is not. Both are case insensitive. Revoked users are dropped from the
+// indexes so that their email can be reused.
+var (
+	emailIndexPrefix = []byte("email:")
+	nameIndexPrefix  = []byte("name:")
+)
+
+// ErrEmailInUse is returned when a user would share an email with another
+// active user.
+var ErrEmailInUse = errors.New("email is already in use")
+
+func emailIndexKey(email string) []byte {
+	return append(append([]byte{}, emailIndexPrefix...), strings.ToLower(email)...)
+}
+
+func nameIndexPrefixOf(name string) []byte {
+	k := append(append([]byte{}, nameIndexPrefix...), strings.ToLower(name)...)
+	return append(k, 0)
+}
+
+func nameIndexKey(name string, id []byte) []byte {
+	return append(nameIndexPrefixOf(name), id...)
+}
+
+// indexKeys returns the index entries of the user with the given id.
+func indexKeys(id []byte, user *User) map[string][]byte {
+	keys := map[string][]byte{}
+
+	for _, k := range user.Keys {
+		keys[string(keyIndexKey(k.Key))] = id
+	}
+
+	if user.IsRevoked() {
+		return keys
+	}
+
+	keys[string(emailIndexKey(user.Email))] = id
+	keys[string(nameIndexKey(user.Name, id))] = []byte{}
+	return keys
+}
+
+// putUser adds the writes that store user under id to b, replacing the index
+// entries of old, which is nil for a new user. Entries in the key index are
+// never removed since retired keys must still be found to be rejected.
+func putUser(b *leveldb.Batch, id []byte, old, user *User) error {
+	val, err := proto.Marshal(user)
+	if err != nil {
+		return err
+	}
+	b.Put(userKey(id), val)
+
+	keys := indexKeys(id, user)
+
+	if old != nil {
+		for k := range indexKeys(id, old) {
+			if _, ok := keys[k]; !ok && !bytes.HasPrefix([]byte(k), keyIndexPrefix) {
+				b.Delete([]byte(k))
+			}
+		}
+	}
+
+	for k, v := range keys {
+		b.Put([]byte(k), v)
+	}
+
+	return nil
+}
+
+// checkEmail returns ErrEmailInUse if an active user other than the one with
+// the given id has the email.
+func (s *Store) checkEmail(email string, id []byte) error {
+	var ro opt.ReadOptions
+	other, err := s.db.Get(emailIndexKey(email), &ro)
+	if err == leveldb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(other, id) {
+		return ErrEmailInUse
+	}
+
+	return nil
+}
+
+// writeUser stores user under id along with its index entries and, if e is
+// not nil, the audit entry e with the user as its subject. If extra is not
+// nil, it is called to add more writes to the same batch. Changes to an
+// existing user go through mutateUser instead, so that they are not based on
+// a stale copy.
+func (s *Store) writeUser(id []byte, user *User, e *AuditEntry, extra func(*leveldb.Batch)) error {
+	s.ulck.Lock()
+	defer s.ulck.Unlock()
+
+	old, err := s.FindUser(id)
+	if err == ErrNoUser {
+		old = nil
+	} else if err != nil {
+		return err
+	}
+
+	return s.commitUser(id, old, user, e, extra)
+}
+
+// mutateUser reads the user identified by id, calls f to modify it and, unless
+// f returns an error, writes it back along with the audit entry e if it is not
+// nil. The lock is held throughout so that concurrent changes to the same user
+// are never lost.
+func (s *Store) mutateUser(id []byte, e *AuditEntry, f func(*User) error) (*User, error) {
+	s.ulck.Lock()
+	defer s.ulck.Unlock()
+
+	user, err := s.FindUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	old := proto.Clone(user).(*User)
+	if err := f(user); err != nil {
+		return nil, err
+	}
+
+	if err := s.commitUser(id, old, user, e, nil); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// commitUser replaces old, which is nil for a new user, with user. The caller
+// holds ulck.
+func (s *Store) commitUser(id []byte, old, user *User, e *AuditEntry, extra func(*leveldb.Batch)) error {
+	if !user.IsRevoked() {
+		if err := s.checkEmail(user.Email, id); err != nil {
+			return err
+		}
+	}
+
+	var b leveldb.Batch
+	if err := putUser(&b, id, old, user); err != nil {
+		return err
+	}
+
+	if extra != nil {
+		extra(&b)
+	}
+
+	if e != nil {
+		e.Subject = id
+		return s.writeAudited(&b, e)
+	}
+
+	return s.db.Write(&b, &opt.WriteOptions{
+		Sync: true,
+	})
+}
+
+// FindUserByEmail returns the id of the active user with the given email
+// along with the user, or ErrNoUser.
+func (s *Store) FindUserByEmail(email string) ([]byte, *User, error) {
+	var ro opt.ReadOptions
+	id, err := s.db.Get(emailIndexKey(email), &ro)
+	if err == leveldb.ErrNotFound {
+		return nil, nil, ErrNoUser
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := s.FindUser(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return id, user, nil
+}
+
+// FindUsersByName returns the ids of the active users with the given name.
+func (s *Store) FindUsersByName(name string) ([][]byte, error) {
+	prefix := nameIndexPrefixOf(name)
+
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(util.BytesPrefix(prefix), &ro)
+	defer it.Release()
+
+	var ids [][]byte
+	for it.Next() {
+		ids = append(ids, append([]byte{}, it.Key()[len(prefix):]...))
+	}
+
+	return ids, it.Error()
+}
+
+// expectedIndexes returns the index entries derived from the users. Users
+// whose emails collide with that of an earlier user, in order of id, are
+// reported and left out of the email index.
+func (s *Store) expectedIndexes() (map[string][]byte, []string, error) {
+	expected := map[string][]byte{}
+	var conflicts []string
+
+	if err := s.ForEachUser(func(id []byte, user *User) error {
+		id = append([]byte{}, id...)
+		for k, v := range indexKeys(id, user) {
+			if prev, ok := expected[k]; ok && !bytes.Equal(prev, v) {
+				conflicts = append(conflicts, fmt.Sprintf("%s is shared by %x and %x", k, prev, id))
+				continue
+			}
+			expected[k] = v
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return expected, conflicts, nil
+}
+
+var indexPrefixes = [][]byte{keyIndexPrefix, emailIndexPrefix, nameIndexPrefix}
+
+// VerifyIndexes compares the indexes with the users and returns a
+// description of every discrepancy.
+func (s *Store) VerifyIndexes() ([]string, error) {
+	expected, problems, err := s.expectedIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+
+	var ro opt.ReadOptions
+	for _, prefix := range indexPrefixes {
+		it := s.db.NewIterator(util.BytesPrefix(prefix), &ro)
+		for it.Next() {
+			k := string(it.Key())
+			found[k] = true
+
+			v, ok := expected[k]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("stale entry %q", k))
+			} else if !bytes.Equal(v, it.Value()) {
+				problems = append(problems, fmt.Sprintf("wrong user for %q", k))
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	for k := range expected {
+		if !found[k] {
+			problems = append(problems, fmt.Sprintf("missing entry %q", k))
+		}
+	}
+
+	return problems, nil
+}
+
+// RebuildIndexes replaces the indexes with ones derived from the users. The
+// users whose emails collide are returned; the first of them, in order of id,
+// keeps the email.
+func (s *Store) RebuildIndexes() ([]string, error) {
+	s.ulck.Lock()
+	defer s.ulck.Unlock()
+
+	expected, conflicts, err := s.expectedIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	var b leveldb.Batch
+
+	var ro opt.ReadOptions
+	for _, prefix := range indexPrefixes {
+		it := s.db.NewIterator(util.BytesPrefix(prefix), &ro)
+		for it.Next() {
+			if _, ok := expected[string(it.Key())]; !ok {
+				b.Delete(append([]byte{}, it.Key()...))
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range expected {
+		b.Put([]byte(k), v)
+	}
+
+	if err := s.db.Write(&b, &opt.WriteOptions{
+		Sync: true,
+	}); err != nil {
+		return nil, err
+	}
+
+	return conflicts, nil
+}
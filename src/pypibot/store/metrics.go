@@ -0,0 +1,75 @@
+package store
+
+import (
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"pypibot/metrics"
+)
+
+var metricOpDuration = metrics.Default.NewHistogram(
+	"pypibot_store_op_duration_seconds",
+	"Time taken by operations on user.db, by operation. Iterations are timed until they are released.",
+	metrics.LatencyBuckets,
+	"op")
+
+var (
+	metricGet     = metricOpDuration.With("get")
+	metricHas     = metricOpDuration.With("has")
+	metricPut     = metricOpDuration.With("put")
+	metricDelete  = metricOpDuration.With("delete")
+	metricWrite   = metricOpDuration.With("write")
+	metricIterate = metricOpDuration.With("iterate")
+)
+
+// timedDB records the latency of the operations on the db that the store
+// uses.
+type timedDB struct {
+	*leveldb.DB
+}
+
+func (db timedDB) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	defer metricGet.ObserveSince(time.Now())
+	return db.DB.Get(key, ro)
+}
+
+func (db timedDB) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	defer metricHas.ObserveSince(time.Now())
+	return db.DB.Has(key, ro)
+}
+
+func (db timedDB) Put(key, value []byte, wo *opt.WriteOptions) error {
+	defer metricPut.ObserveSince(time.Now())
+	return db.DB.Put(key, value, wo)
+}
+
+func (db timedDB) Delete(key []byte, wo *opt.WriteOptions) error {
+	defer metricDelete.ObserveSince(time.Now())
+	return db.DB.Delete(key, wo)
+}
+
+func (db timedDB) Write(b *leveldb.Batch, wo *opt.WriteOptions) error {
+	defer metricWrite.ObserveSince(time.Now())
+	return db.DB.Write(b, wo)
+}
+
+func (db timedDB) NewIterator(r *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return &timedIterator{
+		Iterator: db.DB.NewIterator(r, ro),
+		start:    time.Now(),
+	}
+}
+
+type timedIterator struct {
+	iterator.Iterator
+	start time.Time
+}
+
+func (it *timedIterator) Release() {
+	it.Iterator.Release()
+	metricIterate.ObserveSince(it.start)
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// schemaKey holds the version of the layout of user.db as a big endian
+// uint32. Stores without one predate versioning and are at version 0.
+var schemaKey = []byte("meta:schema")
+
+// migration upgrades user.db from the version before it to its own.
+type migration func(s *Store) error
+
+// migrations are run in order on Open; the one at index i upgrades a store
+// from version i to i+1. Migrations must only ever be appended.
+var migrations = []migration{
+	migrateUserPrefix,
+	migrateIndexes,
+	migrateUserIds,
+	migrateAuditHead,
+}
+
+// schemaVersion is the version of stores written by this code.
+var schemaVersion = uint32(len(migrations))
+
+// SchemaVersion returns the version of the layout of user.db.
+func (s *Store) SchemaVersion() (uint32, error) {
+	var ro opt.ReadOptions
+	val, err := s.db.Get(schemaKey, &ro)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if len(val) != 4 {
+		return 0, fmt.Errorf("invalid schema version: %x", val)
+	}
+
+	return binary.BigEndian.Uint32(val), nil
+}
+
+func putSchemaVersion(b *leveldb.Batch, v uint32) {
+	var val [4]byte
+	binary.BigEndian.PutUint32(val[:], v)
+	b.Put(schemaKey, val[:])
+}
+
+func (s *Store) writeSchemaVersion(v uint32) error {
+	var b leveldb.Batch
+	putSchemaVersion(&b, v)
+	return s.db.Write(&b, &opt.WriteOptions{
+		Sync: true,
+	})
+}
+
+// migrate runs the migrations the store has not had. The version is recorded
+// after each one, so an interrupted upgrade resumes where it stopped.
+func (s *Store) migrate() error {
+	v, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if v > schemaVersion {
+		return fmt.Errorf("user.db is at version %d, newer than the supported %d", v, schemaVersion)
+	}
+
+	for ; v < schemaVersion; v++ {
+		if err := migrations[v](s); err != nil {
+			return fmt.Errorf("migrating user.db to version %d: %s", v+1, err)
+		}
+
+		if err := s.writeSchemaVersion(v + 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateUserPrefix moves users from their bare DER keys, which begin with an
+// ASN.1 SEQUENCE tag, to keys under userPrefix.
+func migrateUserPrefix(s *Store) error {
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(&util.Range{
+		Start: []byte{0x30},
+		Limit: []byte{0x31},
+	}, &ro)
+	defer it.Release()
+
+	var b leveldb.Batch
+	for it.Next() {
+		id := append([]byte{}, it.Key()...)
+		b.Put(userKey(id), append([]byte{}, it.Value()...))
+		b.Delete(id)
+	}
+
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	return s.db.Write(&b, &opt.WriteOptions{
+		Sync: true,
+	})
+}
+
+// migrateIndexes builds the key, email and name indexes, which stores from
+// before them lack. Users whose emails collide keep their records but only
+// the first of them is found by email.
+func migrateIndexes(s *Store) error {
+	_, err := s.RebuildIndexes()
+	return err
+}
+
+// migrateUserIds gives every user a random id in place of the key it was
+// created with, which until then was its id, and updates the groups, grants
+// and tokens that refer to users.
+func migrateUserIds(s *Store) error {
+	var b leveldb.Batch
+	ids := map[string][]byte{}
+
+	if err := s.ForEachUser(func(old []byte, user *User) error {
+		if len(user.Id) != 0 {
+			return nil
+		}
+
+		id, err := newUserId()
+		if err != nil {
+			return err
+		}
+
+		user.Id = id
+
+		// users created before keys were tracked hold only the key that was
+		// their id.
+		if len(user.Keys) == 0 {
+			user.Keys = []*Key{
+				{
+					Key: append([]byte{}, old...),
+				},
+			}
+		}
+
+		val, err := proto.Marshal(user)
+		if err != nil {
+			return err
+		}
+
+		b.Delete(userKey(old))
+		b.Put(userKey(id), val)
+		ids[string(old)] = id
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// newId maps the id of a user to its new one, leaving empty ids alone.
+	newId := func(old []byte) []byte {
+		if id, ok := ids[string(old)]; ok {
+			return id
+		}
+		return old
+	}
+
+	if err := s.ForEachGroup(func(g *Group) error {
+		for i, m := range g.Members {
+			g.Members[i] = newId(m)
+		}
+
+		val, err := proto.Marshal(g)
+		if err != nil {
+			return err
+		}
+		b.Put(groupKey(g.Name), val)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := s.ForEachGrant(func(g *Grant) error {
+		b.Delete(grantKey(g))
+		g.User, g.Bot = newId(g.User), newId(g.Bot)
+
+		val, err := proto.Marshal(g)
+		if err != nil {
+			return err
+		}
+		b.Put(grantKey(g), val)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := s.ForEachToken(func(tokenId string, t *Token) error {
+		t.User = newId(t.User)
+
+		val, err := proto.Marshal(t)
+		if err != nil {
+			return err
+		}
+		b.Put(tokenKey(tokenId), val)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := s.db.Write(&b, &opt.WriteOptions{
+		Sync: true,
+	}); err != nil {
+		return err
+	}
+
+	_, err := s.RebuildIndexes()
+	return err
+}
+
+// migrateAuditHead records the end of the audit log in the head file, which
+// stores from before it lack.
+func migrateAuditHead(s *Store) error {
+	seq, digest, err := s.lastAuditEntry()
+	if err != nil {
+		return err
+	}
+	return writeAuditHeadFile(s.path, seq, digest)
+}
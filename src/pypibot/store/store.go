@@ -1,17 +1,25 @@
 package store
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/scalingdata/gcfg"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 
 	"pypibot/auth"
 )
@@ -23,21 +31,82 @@ const (
 	defaultWebAddr = ":8080"
 	defaultRpcAddr = ":8081"
 
-	bitsInRsaKeys = 2048
+	defaultClientCertDays = 1000
+	defaultKeyGraceDays   = 7
 
+	defaultMaxFrameSize    = 1 << 20
+	defaultTimeoutSecs     = 30
+	defaultIdleTimeoutSecs = 300
+
+	caCrtFile  = "ca.crt.pem"
+	caKeyFile  = "ca.key.pem"
 	srvCrtFile = "srv.crt.pem"
 	srvKeyFile = "srv.key.pem"
 
+	// ServerName is the default DNS name in the server's cert.
 	ServerName = "kellego.us"
+
+	defaultIp = "127.0.0.1"
+
+	day = 24 * time.Hour
+)
+
+var defaultDnsNames = []string{ServerName, "pypi." + ServerName, "localhost"}
+
+// Each type of record is stored under its own prefix. Users are keyed by
+// their id and the key index maps the DER encoding of each of a user's public
+// keys to the user's id.
+var (
+	userPrefix     = []byte("user:")
+	keyIndexPrefix = []byte("key:")
 )
 
+func userKey(id []byte) []byte {
+	return append(append([]byte{}, userPrefix...), id...)
+}
+
+const userIdSize = 16
+
+// newUserId returns a random id for a new user.
+func newUserId() ([]byte, error) {
+	id := make([]byte, userIdSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// ErrNoUser is returned when no user is found for a key.
+var ErrNoUser = errors.New("no such user")
+
+// ErrKeyExpired is returned when a user is found for a key that has been
+// retired by a key rotation.
+var ErrKeyExpired = errors.New("key has expired")
+
 type Config struct {
 	Web struct {
 		Addr string
+		Tls  bool
 	}
 
 	Rpc struct {
-		Addr string
+		Addr             string
+		MaxFrameSize     int      `gcfg:"max-frame-size"`
+		FrameSize        []string `gcfg:"frame-size"`
+		ReadTimeoutSecs  int      `gcfg:"read-timeout-secs"`
+		WriteTimeoutSecs int      `gcfg:"write-timeout-secs"`
+		IdleTimeoutSecs  int      `gcfg:"idle-timeout-secs"`
+	}
+
+	Auth struct {
+		KeyType        string `gcfg:"key-type"`
+		ClientCertDays int    `gcfg:"client-cert-days"`
+		KeyGraceDays   int    `gcfg:"key-grace-days"`
+	}
+
+	Tls struct {
+		DnsName []string `gcfg:"dns-name"`
+		Ip      []string
 	}
 }
 
@@ -45,31 +114,161 @@ func (c *Config) ReadFromFile(filename string) error {
 	return gcfg.ReadFileInto(c, filename)
 }
 
+// ServerNames returns the DNS names and IP addresses that are included in
+// the server's cert.
+func (c *Config) ServerNames() ([]string, []net.IP, error) {
+	if len(c.Tls.DnsName) == 0 && len(c.Tls.Ip) == 0 {
+		return defaultDnsNames, []net.IP{net.ParseIP(defaultIp)}, nil
+	}
+
+	var ips []net.IP
+	for _, s := range c.Tls.Ip {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid ip in [tls]: %s", s)
+		}
+		ips = append(ips, ip)
+	}
+
+	return c.Tls.DnsName, ips, nil
+}
+
+// KeyType is the algorithm of keys generated by the store unless another is
+// requested.
+func (c *Config) KeyType() (auth.KeyType, error) {
+	if c.Auth.KeyType == "" {
+		return auth.RSA, nil
+	}
+	return auth.ParseKeyType(c.Auth.KeyType)
+}
+
+// ClientCertLifetime is how long newly issued client certs remain valid.
+func (c *Config) ClientCertLifetime() time.Duration {
+	if c.Auth.ClientCertDays <= 0 {
+		return defaultClientCertDays * day
+	}
+	return time.Duration(c.Auth.ClientCertDays) * day
+}
+
+// MaxFrameSize is the largest rpc frame body, in bytes, that is accepted for
+// any message type.
+func (c *Config) MaxFrameSize() uint32 {
+	if c.Rpc.MaxFrameSize <= 0 {
+		return defaultMaxFrameSize
+	}
+	return uint32(c.Rpc.MaxFrameSize)
+}
+
+// FrameSizes returns the per message type limits on rpc frame bodies, keyed
+// by the fully qualified message name. Each frame-size entry in [rpc] has the
+// form "<message name> <bytes>", e.g. "rpc.PingReq 64". A limit larger than
+// MaxFrameSize has no effect.
+func (c *Config) FrameSizes() (map[string]uint32, error) {
+	sizes := map[string]uint32{}
+	for _, v := range c.Rpc.FrameSize {
+		var name string
+		var size uint32
+		if _, err := fmt.Sscanf(v, "%s %d", &name, &size); err != nil {
+			return nil, fmt.Errorf("invalid frame-size in [rpc]: %s", v)
+		}
+		sizes[name] = size
+	}
+	return sizes, nil
+}
+
+// ReadTimeout is how long the rpc server waits for the body of a frame once
+// its header has arrived.
+func (c *Config) ReadTimeout() time.Duration {
+	if c.Rpc.ReadTimeoutSecs <= 0 {
+		return defaultTimeoutSecs * time.Second
+	}
+	return time.Duration(c.Rpc.ReadTimeoutSecs) * time.Second
+}
+
+// WriteTimeout is how long the rpc server waits for a frame to be written.
+func (c *Config) WriteTimeout() time.Duration {
+	if c.Rpc.WriteTimeoutSecs <= 0 {
+		return defaultTimeoutSecs * time.Second
+	}
+	return time.Duration(c.Rpc.WriteTimeoutSecs) * time.Second
+}
+
+// IdleTimeout is how long the rpc server waits for the next frame before
+// closing the connection. Clients that stay connected ping within it.
+func (c *Config) IdleTimeout() time.Duration {
+	if c.Rpc.IdleTimeoutSecs <= 0 {
+		return defaultIdleTimeoutSecs * time.Second
+	}
+	return time.Duration(c.Rpc.IdleTimeoutSecs) * time.Second
+}
+
+// KeyGracePeriod is how long a user's previous keys continue to be accepted
+// after a key rotation.
+func (c *Config) KeyGracePeriod() time.Duration {
+	if c.Auth.KeyGraceDays <= 0 {
+		return defaultKeyGraceDays * day
+	}
+	return time.Duration(c.Auth.KeyGraceDays) * day
+}
+
 type Store struct {
 	Config *Config
 
-	db   *leveldb.DB
+	db   timedDB
 	path string
+
+	lck      sync.Mutex
+	onRevoke []func([]byte)
+
+	// ulck serializes writes of users so that their index entries stay
+	// consistent.
+	ulck sync.Mutex
+
+	// alck guards the sequence number and digest of the last audit entry.
+	// auditHeadStale is set once the log does not agree with the head
+	// file, which is then left alone.
+	alck           sync.Mutex
+	auditSeq       uint64
+	auditHead      []byte
+	auditHeadStale bool
+
+	// flck guards the failures to authenticate seen from each host, see
+	// AuditAuthFailure.
+	flck         sync.Mutex
+	authFailures map[string]*authFailures
 }
 
 func (s *Store) Close() error {
 	return s.db.Close()
 }
 
-func newCAPool(crtPem *pem.Block) (*x509.CertPool, error) {
+func newCAPool(crtPems ...*pem.Block) (*x509.CertPool, error) {
 	p := x509.NewCertPool()
 
-	crt, err := x509.ParseCertificate(crtPem.Bytes)
-	if err != nil {
-		return nil, err
-	}
+	for _, crtPem := range crtPems {
+		crt, err := x509.ParseCertificate(crtPem.Bytes)
+		if err != nil {
+			return nil, err
+		}
 
-	p.AddCert(crt)
+		p.AddCert(crt)
+	}
 
 	return p, nil
 }
 
 func (s *Store) ServerTlsConfig() (*tls.Config, error) {
+	return s.serverTlsConfig(tls.RequireAndVerifyClientCert)
+}
+
+// WebTlsConfig returns the TLS config for the web server, which presents the
+// same cert as the rpc server. Client certs are verified if given but not
+// required, since api requests may instead carry a bearer token.
+func (s *Store) WebTlsConfig() (*tls.Config, error) {
+	return s.serverTlsConfig(tls.VerifyClientCertIfGiven)
+}
+
+func (s *Store) serverTlsConfig(clientAuth tls.ClientAuthType) (*tls.Config, error) {
 	crtPem, keyPem, err := auth.ReadBothPems(
 		filepath.Join(s.path, srvCrtFile),
 		filepath.Join(s.path, srvKeyFile))
@@ -77,7 +276,7 @@ func (s *Store) ServerTlsConfig() (*tls.Config, error) {
 		return nil, err
 	}
 
-	prv, err := x509.ParsePKCS1PrivateKey(keyPem.Bytes)
+	prv, err := auth.ParsePrivateKey(keyPem)
 	if err != nil {
 		return nil, err
 	}
@@ -87,54 +286,256 @@ func (s *Store) ServerTlsConfig() (*tls.Config, error) {
 		PrivateKey:  prv,
 	}
 
-	p, err := newCAPool(crtPem)
+	// after a CA rotation, clients that still trust the previous CA verify
+	// the server through the cross-signed cert.
+	if fileExists(filepath.Join(s.path, crossCrtFile)) {
+		crossPem, err := auth.ReadPem(filepath.Join(s.path, crossCrtFile))
+		if err != nil {
+			return nil, err
+		}
+		crt.Certificate = append(crt.Certificate, crossPem.Bytes)
+	}
+
+	// the CA that issued the server's cert is sent too, so that clients
+	// that enroll knowing only its fingerprint can verify the server.
+	caCrtPem, err := auth.ReadPem(filepath.Join(s.path, caCrtFile))
+	if err != nil {
+		return nil, err
+	}
+	crt.Certificate = append(crt.Certificate, caCrtPem.Bytes)
+
+	caPems, err := s.trustedCAPems()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newCAPool(caPems...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &tls.Config{
 		Certificates: []tls.Certificate{crt},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientAuth:   clientAuth,
 		ClientCAs:    p,
 	}, nil
 }
 
-// CreateUser ...
+// CreateUser creates a user with a key of the store's configured type.
 func (s *Store) CreateUser(email, name string, t User_UserType) (*User, *pem.Block, *pem.Block, error) {
-	srvCrtPem, srvKeyPem, err := auth.ReadBothPems(
-		filepath.Join(s.path, srvCrtFile),
-		filepath.Join(s.path, srvKeyFile))
+	kt, err := s.Config.KeyType()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return s.CreateUserWithKeyType(email, name, t, kt)
+}
+
+// CreateUserWithKeyType ...
+func (s *Store) CreateUserWithKeyType(email, name string, t User_UserType, kt auth.KeyType) (*User, *pem.Block, *pem.Block, error) {
+	caCrtPem, caKeyPem, err := s.issuerPems()
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("Unable to read server cert: %s", err)
 	}
 
-	crtPem, keyPem, err := auth.GenerateClientCert(bitsInRsaKeys, srvCrtPem, srvKeyPem)
+	crtPem, keyPem, err := auth.GenerateClientCert(
+		kt,
+		caCrtPem,
+		caKeyPem,
+		s.Config.ClientCertLifetime())
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("unable to generate client cert: %s", err)
 	}
 
+	key, err := publicKeyFromPem(keyPem)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	user := &User{
 		Email: email,
 		Name:  name,
 		Type:  t,
+		Keys: []*Key{
+			{
+				Key:     key,
+				Created: time.Now().Unix(),
+				Issuer:  auth.Fingerprint(caCrtPem),
+			},
+		},
 	}
 
-	if err := s.AddUser(user, keyPem); err != nil {
+	if err := s.AddUser(user, keyPem); err == ErrEmailInUse {
+		return nil, nil, nil, err
+	} else if err != nil {
 		return nil, nil, nil, fmt.Errorf("unable to insert user: %s", err)
 	}
 
 	return user, crtPem, keyPem, nil
 }
 
+// CreateUserWithPublicKey creates a user holding pub, the DER encoded PKIX
+// public key of a private key the user already has, and issues a cert for
+// it.
+func (s *Store) CreateUserWithPublicKey(email, name string, t User_UserType, pub []byte) (*User, *pem.Block, error) {
+	key, err := x509.ParsePKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caCrtPem, caKeyPem, err := s.issuerPems()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read server cert: %s", err)
+	}
+
+	crtPem, err := auth.IssueClientCert(
+		key,
+		caCrtPem,
+		caKeyPem,
+		s.Config.ClientCertLifetime())
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to issue client cert: %s", err)
+	}
+
+	user := &User{
+		Email: email,
+		Name:  name,
+		Type:  t,
+		Keys: []*Key{
+			{
+				Key:     pub,
+				Created: time.Now().Unix(),
+				Issuer:  auth.Fingerprint(caCrtPem),
+			},
+		},
+	}
+
+	if err := s.addUser(user, pub); err == ErrEmailInUse {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("unable to insert user: %s", err)
+	}
+
+	return user, crtPem, nil
+}
+
+// RotateUserKey issues a new cert and key pair for the user identified by id.
+// The user's existing keys continue to be accepted until the configured grace
+// period has elapsed.
+func (s *Store) RotateUserKey(id []byte) (*User, *pem.Block, *pem.Block, error) {
+	user, err := s.FindUser(id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if user.IsRevoked() {
+		return nil, nil, nil, fmt.Errorf("user %s is revoked", user.Email)
+	}
+
+	kt, err := s.Config.KeyType()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	caCrtPem, caKeyPem, err := s.issuerPems()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to read server cert: %s", err)
+	}
+
+	crtPem, keyPem, err := auth.GenerateClientCert(
+		kt,
+		caCrtPem,
+		caKeyPem,
+		s.Config.ClientCertLifetime())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to generate client cert: %s", err)
+	}
+
+	key, err := publicKeyFromPem(keyPem)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	user, err = s.mutateUser(id, &AuditEntry{
+		Event: AuditKeyRotated,
+	}, func(user *User) error {
+		// the user may have been revoked while the cert was generated.
+		if user.IsRevoked() {
+			return fmt.Errorf("user %s is revoked", user.Email)
+		}
+
+		now := time.Now()
+
+		expires := now.Add(s.Config.KeyGracePeriod()).Unix()
+		for _, k := range user.Keys {
+			if k.Expires == 0 || k.Expires > expires {
+				k.Expires = expires
+			}
+		}
+
+		user.Keys = append(user.Keys, &Key{
+			Key:     key,
+			Created: now.Unix(),
+			Issuer:  auth.Fingerprint(caCrtPem),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return user, crtPem, keyPem, nil
+}
+
+// AddUser stores a new user holding the private key in key and assigns the
+// user an id. ErrEmailInUse is returned if another active user has the same
+// email.
 func (s *Store) AddUser(user *User, key *pem.Block) error {
-	return addUser(s.db, user, key)
+	pub, err := publicKeyFromPem(key)
+	if err != nil {
+		return err
+	}
+
+	return s.addUser(user, pub)
 }
 
-func (s *Store) FindUser(key []byte) (*User, error) {
-	var ro opt.ReadOptions
+// addUser stores a new user holding the public key pub, see AddUser.
+func (s *Store) addUser(user *User, pub []byte) error {
+	if len(user.Keys) == 0 {
+		user.Keys = []*Key{
+			{
+				Key:     pub,
+				Created: time.Now().Unix(),
+			},
+		}
+	}
 
-	val, err := s.db.Get(key, &ro)
+	if inUse, err := s.keyInUse(pub); err != nil {
+		return err
+	} else if inUse {
+		return errors.New("key is already in use")
+	}
+
+	id, err := newUserId()
 	if err != nil {
+		return err
+	}
+	user.Id = id
+
+	return s.writeUser(id, user, &AuditEntry{
+		Event:  AuditUserCreated,
+		Detail: fmt.Sprintf("%s %s %s", user.Email, user.Name, user.Type),
+	}, nil)
+}
+
+// FindUser returns the user with the given id, or ErrNoUser.
+func (s *Store) FindUser(id []byte) (*User, error) {
+	var ro opt.ReadOptions
+
+	val, err := s.db.Get(userKey(id), &ro)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNoUser
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -146,9 +547,171 @@ func (s *Store) FindUser(key []byte) (*User, error) {
 	return &user, nil
 }
 
+// IsRevoked indicates whether the user has been revoked.
+func (u *User) IsRevoked() bool {
+	return u.Revocation != nil
+}
+
+// RevokeUser marks the user identified by id as revoked. The user record is
+// kept so that the history of the user remains available. Functions
+// registered with OnRevoke are called before RevokeUser returns.
+func (s *Store) RevokeUser(id []byte, reason string) error {
+	if _, err := s.mutateUser(id, &AuditEntry{
+		Event:  AuditUserRevoked,
+		Detail: reason,
+	}, func(user *User) error {
+		if user.IsRevoked() {
+			return fmt.Errorf("user %s is already revoked", user.Email)
+		}
+
+		user.Revocation = &Revocation{
+			Reason: reason,
+			Time:   time.Now().Unix(),
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.notifyRevoke(id)
+	return nil
+}
+
+// notifyRevoke calls the functions registered with OnRevoke.
+func (s *Store) notifyRevoke(id []byte) {
+	s.lck.Lock()
+	fns := s.onRevoke
+	s.lck.Unlock()
+
+	for _, f := range fns {
+		f(id)
+	}
+}
+
+// UpdateUser calls f with the user identified by id and stores the user as
+// modified by f unless f returns an error. Keys and revocation are managed by
+// their own methods and cannot be changed through f. If the user's type
+// changes, the functions registered with OnRevoke are called, as for a
+// revocation, since live sessions hold the permissions of the old type.
+func (s *Store) UpdateUser(id []byte, f func(*User) error) (*User, error) {
+	e := &AuditEntry{
+		Event: AuditUserUpdated,
+	}
+
+	var typeChanged bool
+	user, err := s.mutateUser(id, e, func(user *User) error {
+		old := proto.Clone(user).(*User)
+		if err := f(user); err != nil {
+			return err
+		}
+		user.Keys, user.Revocation = old.Keys, old.Revocation
+
+		e.Detail = describeUpdate(old, user)
+		typeChanged = old.Type != user.Type
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if typeChanged {
+		s.notifyRevoke(id)
+	}
+
+	return user, nil
+}
+
+// describeUpdate lists the fields that differ between old and user.
+func describeUpdate(old, user *User) string {
+	var changes []string
+	if old.Email != user.Email {
+		changes = append(changes, fmt.Sprintf("email %s -> %s", old.Email, user.Email))
+	}
+	if old.Name != user.Name {
+		changes = append(changes, fmt.Sprintf("name %s -> %s", old.Name, user.Name))
+	}
+	if old.Type != user.Type {
+		changes = append(changes, fmt.Sprintf("type %s -> %s", old.Type, user.Type))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// OnRevoke registers f to be called with the id of each user that is
+// revoked through RevokeUser or whose type is changed through UpdateUser.
+func (s *Store) OnRevoke(f func(id []byte)) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.onRevoke = append(s.onRevoke, f)
+}
+
+// FindUserByKey finds the user that holds key, which may be either the key
+// the user was created with or one issued by RotateUserKey. It returns the
+// id of the user along with the user. ErrKeyExpired is returned if the key
+// has been retired.
+func (s *Store) FindUserByKey(key []byte) ([]byte, *User, error) {
+	var ro opt.ReadOptions
+
+	id, err := s.db.Get(keyIndexKey(key), &ro)
+	if err == leveldb.ErrNotFound {
+		return nil, nil, ErrNoUser
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := s.FindUser(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().Unix()
+	for _, k := range user.Keys {
+		if bytes.Equal(k.Key, key) && k.Expires != 0 && k.Expires < now {
+			return nil, nil, ErrKeyExpired
+		}
+	}
+
+	return id, user, nil
+}
+
+// Authenticate finds the user holding the public key of the leaf of certs,
+// which are the certs presented by a TLS peer. Only the leaf is verified by
+// the TLS stack, so any other certs in the chain are ignored. Unknown,
+// expired and revoked keys are rejected.
+func (s *Store) Authenticate(certs []*x509.Certificate) ([]byte, *User, error) {
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no client certificate")
+	}
+
+	key, err := x509.MarshalPKIXPublicKey(certs[0].PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, u, err := s.FindUserByKey(key)
+	if err == ErrNoUser {
+		return nil, nil, errors.New("certificate not authorized")
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if u.IsRevoked() {
+		return nil, nil, fmt.Errorf("certificate revoked for %s", u.Email)
+	}
+
+	return id, u, nil
+}
+
+// keyInUse indicates whether key belongs to any user.
+func (s *Store) keyInUse(key []byte) (bool, error) {
+	var ro opt.ReadOptions
+	return s.db.Has(keyIndexKey(key), &ro)
+}
+
+// ForEachUser calls f for each user in order of id. Only one user is held in
+// memory at a time, so f must copy the user if it keeps it.
 func (s *Store) ForEachUser(f func([]byte, *User) error) error {
 	var ro opt.ReadOptions
-	it := s.db.NewIterator(nil, &ro)
+	it := s.db.NewIterator(util.BytesPrefix(userPrefix), &ro)
 	defer it.Release()
 
 	var user User
@@ -157,7 +720,7 @@ func (s *Store) ForEachUser(f func([]byte, *User) error) error {
 			return err
 		}
 
-		if err := f(it.Key(), &user); err != nil {
+		if err := f(it.Key()[len(userPrefix):], &user); err != nil {
 			return err
 		}
 	}
@@ -165,50 +728,192 @@ func (s *Store) ForEachUser(f func([]byte, *User) error) error {
 	return it.Error()
 }
 
-func addUserWithKeyBytes(db *leveldb.DB, user *User, key []byte) error {
-	val, err := proto.Marshal(user)
+// ForEachUserByEmail calls f for each user in order of email, starting after
+// the user with email after or at the first user if after is empty. If
+// reverse is true, users are visited in descending order of email. Emails
+// are compared in lower case, as they are indexed. The users are read from a
+// snapshot, so each is visited once even while others are changed.
+func (s *Store) ForEachUserByEmail(after string, reverse bool, f func([]byte, *User) error) error {
+	snap, err := s.db.GetSnapshot()
 	if err != nil {
 		return err
 	}
+	defer snap.Release()
 
-	return db.Put(key, val, &opt.WriteOptions{
-		Sync: true,
-	})
-}
+	r := util.BytesPrefix(emailIndexPrefix)
 
-func addUser(db *leveldb.DB, user *User, keyPem *pem.Block) error {
-	prv, err := x509.ParsePKCS1PrivateKey(keyPem.Bytes)
-	if err != nil {
-		return err
+	if after != "" {
+		if reverse {
+			r.Limit = emailIndexKey(after)
+		} else {
+			// the smallest key that sorts after the email.
+			r.Start = append(emailIndexKey(after), 0)
+		}
+	}
+
+	var ro opt.ReadOptions
+	it := snap.NewIterator(r, &ro)
+	defer it.Release()
+
+	first, next := it.First, it.Next
+	if reverse {
+		first, next = it.Last, it.Prev
 	}
 
-	pub, err := x509.MarshalPKIXPublicKey(&prv.PublicKey)
+	var user User
+	for ok := first(); ok; ok = next() {
+		val, err := snap.Get(userKey(it.Value()), &ro)
+		if err != nil {
+			return err
+		}
+
+		if err := proto.Unmarshal(val, &user); err != nil {
+			return err
+		}
+
+		if err := f(it.Value(), &user); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+func keyIndexKey(key []byte) []byte {
+	return append(append([]byte{}, keyIndexPrefix...), key...)
+}
+
+func publicKeyFromPem(keyPem *pem.Block) ([]byte, error) {
+	prv, err := auth.ParsePrivateKey(keyPem)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return addUserWithKeyBytes(db, user, pub)
+	return auth.GetPublicKey(prv)
 }
 
-func writeDefaultConfig(filename string) error {
+func writeDefaultConfig(filename string, kt auth.KeyType) error {
 	w, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
-	if _, err := fmt.Fprintf(w, "[web]\naddr=%s\n\n", defaultWebAddr); err != nil {
+	if _, err := fmt.Fprintf(w, "[web]\naddr=%s\ntls=true\n\n", defaultWebAddr); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "[rpc]\naddr=%s\nmax-frame-size=%d\nread-timeout-secs=%d\nwrite-timeout-secs=%d\nidle-timeout-secs=%d\n\n",
+		defaultRpcAddr,
+		defaultMaxFrameSize,
+		defaultTimeoutSecs,
+		defaultTimeoutSecs,
+		defaultIdleTimeoutSecs); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "[auth]\nkey-type=%s\nclient-cert-days=%d\nkey-grace-days=%d\n\n",
+		kt,
+		defaultClientCertDays,
+		defaultKeyGraceDays); err != nil {
 		return err
 	}
 
-	if _, err := fmt.Fprintf(w, "[rpc]\naddr=%s\n\n", defaultRpcAddr); err != nil {
+	if _, err := fmt.Fprintln(w, "[tls]"); err != nil {
+		return err
+	}
+
+	for _, name := range defaultDnsNames {
+		if _, err := fmt.Fprintf(w, "dns-name=%s\n", name); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "ip=%s\n\n", defaultIp); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func Create(path string) error {
+// writeServerCert issues a new cert for the server that is signed by the
+// CA and includes the names in cfg. The server's key is encrypted, with the
+// same passphrase, if the CA's is.
+func writeServerCert(path string, cfg *Config) error {
+	dnsNames, ips, err := cfg.ServerNames()
+	if err != nil {
+		return err
+	}
+
+	kt, err := cfg.KeyType()
+	if err != nil {
+		return err
+	}
+
+	caCrtPem, caKeyPem, err := auth.ReadBothPems(
+		filepath.Join(path, caCrtFile),
+		filepath.Join(path, caKeyFile))
+	if err != nil {
+		return err
+	}
+
+	srvCrt, srvKey, err := auth.GenerateServerCert(
+		kt,
+		caCrtPem,
+		caKeyPem,
+		dnsNames,
+		ips)
+	if err != nil {
+		return err
+	}
+
+	var p auth.Passphrase
+	if enc, err := auth.IsEncryptedFile(filepath.Join(path, caKeyFile)); err != nil {
+		return err
+	} else if enc {
+		p = auth.KeyPassphrase
+	}
+
+	if err := auth.WritePem(srvCrt, filepath.Join(path, srvCrtFile)); err != nil {
+		return err
+	}
+
+	return auth.WriteKeyPem(srvKey, filepath.Join(path, srvKeyFile), p)
+}
+
+// upgradeLayout converts a store in which the server's cert is also the CA
+// into one with a separate CA. The existing cert becomes the CA, so clients
+// that already trust it are able to verify the new server cert.
+func upgradeLayout(path string, cfg *Config) error {
+	if fileExists(filepath.Join(path, caCrtFile)) {
+		return nil
+	}
+
+	for _, f := range [][2]string{
+		{srvCrtFile, caCrtFile},
+		{srvKeyFile, caKeyFile},
+	} {
+		if err := os.Rename(
+			filepath.Join(path, f[0]),
+			filepath.Join(path, f[1])); err != nil {
+			return err
+		}
+	}
+
+	return writeServerCert(path, cfg)
+}
+
+// Create initializes a new store in path whose CA and server keys are of
+// type kt. Keys for users are also of type kt unless otherwise requested.
+func Create(path string, kt auth.KeyType) error {
+	return CreateEncrypted(path, kt, nil)
+}
+
+// CreateEncrypted is like Create but, if p is not nil, the CA and server keys
+// are encrypted with its passphrase. The same passphrase must be set with
+// auth.SetPassphrase, or otherwise be available to auth.ReadPem, for the
+// store to issue certs and serve.
+func CreateEncrypted(path string, kt auth.KeyType, p auth.Passphrase) error {
 	if _, err := os.Stat(path); err == nil {
 		return fmt.Errorf("%s already exists.", path)
 	}
@@ -217,20 +922,30 @@ func Create(path string) error {
 		return err
 	}
 
-	if err := writeDefaultConfig(filepath.Join(path, configFilePath)); err != nil {
+	cfgFile := filepath.Join(path, configFilePath)
+	if err := writeDefaultConfig(cfgFile, kt); err != nil {
+		return err
+	}
+
+	cfg := &Config{}
+	if err := cfg.ReadFromFile(cfgFile); err != nil {
 		return err
 	}
 
-	srvCrt, srvKey, err := auth.GenerateServerCert(bitsInRsaKeys, ServerName)
+	caCrt, caKey, err := auth.GenerateCACert(kt)
 	if err != nil {
 		return err
 	}
 
-	if err := auth.WriteBothPems(
-		srvCrt,
-		filepath.Join(path, srvCrtFile),
-		srvKey,
-		filepath.Join(path, srvKeyFile)); err != nil {
+	if err := auth.WritePem(caCrt, filepath.Join(path, caCrtFile)); err != nil {
+		return err
+	}
+
+	if err := auth.WriteKeyPem(caKey, filepath.Join(path, caKeyFile), p); err != nil {
+		return err
+	}
+
+	if err := writeServerCert(path, cfg); err != nil {
 		return err
 	}
 
@@ -240,7 +955,14 @@ func Create(path string) error {
 	}
 	defer db.Close()
 
-	return nil
+	if err := writeAuditHeadFile(path, 0, nil); err != nil {
+		return err
+	}
+
+	s := &Store{
+		db: timedDB{db},
+	}
+	return s.writeSchemaVersion(schemaVersion)
 }
 
 func Open(path string) (*Store, error) {
@@ -250,6 +972,10 @@ func Open(path string) (*Store, error) {
 		return nil, err
 	}
 
+	if err := upgradeLayout(path, cfg); err != nil {
+		return nil, err
+	}
+
 	var o opt.Options
 	db, err := leveldb.OpenFile(filepath.Join(path, userFilePath), &o)
 	if err != nil {
@@ -261,9 +987,45 @@ func Open(path string) (*Store, error) {
 		return nil, err
 	}
 
-	return &Store{
+	s := &Store{
 		Config: cfg,
-		db:     db,
+		db:     timedDB{db},
 		path:   abs,
-	}, nil
+	}
+
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := s.loadAuditHead(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// IssueServerCert replaces the server's cert with a new one that includes
+// the names currently in the config. Clients are unaffected since they only
+// need to trust the CA.
+func (s *Store) IssueServerCert() error {
+	if err := writeServerCert(s.path, s.Config); err != nil {
+		return err
+	}
+
+	dnsNames, ips, err := s.Config.ServerNames()
+	if err != nil {
+		return err
+	}
+
+	names := append([]string{}, dnsNames...)
+	for _, ip := range ips {
+		names = append(names, ip.String())
+	}
+
+	return s.Audit(&AuditEntry{
+		Event:  AuditServerCertIssued,
+		Detail: strings.Join(names, " "),
+	})
 }
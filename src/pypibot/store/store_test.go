@@ -1,17 +1,31 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"pypibot/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"pypibot/auth"
 )
 
 func getUserCount(s *Store) (int, error) {
 	c := 0
-	if err := s.ForEachUser(func(key []byte, user *pb.User) error {
+	if err := s.ForEachUser(func(key []byte, user *User) error {
 		c++
 		return nil
 	}); err != nil {
@@ -29,7 +43,7 @@ func TestCreateAndOpen(t *testing.T) {
 
 	dst := filepath.Join(tmp, "data")
 
-	if err := Create(dst); err != nil {
+	if err := Create(dst, auth.RSA); err != nil {
 		t.Fatal(err)
 	}
 
@@ -70,3 +84,1649 @@ func TestCreateAndOpen(t *testing.T) {
 		t.Fatalf("expected no users, got %d", uc)
 	}
 }
+
+func publicKeyOf(keyPem *pem.Block) ([]byte, error) {
+	prv, err := x509.ParsePKCS1PrivateKey(keyPem.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.GetPublicKey(prv)
+}
+
+func TestRevokeUser(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	created, _, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := created.Id
+
+	var notified []byte
+	s.OnRevoke(func(k []byte) {
+		notified = k
+	})
+
+	if _, err := s.UpdateUser(id, func(u *User) error {
+		u.Name = "bar"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if notified != nil {
+		t.Fatal("expected OnRevoke not to be called when the type is unchanged")
+	}
+
+	if _, err := s.UpdateUser(id, func(u *User) error {
+		u.Type = User_GOD
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if string(notified) != string(id) {
+		t.Fatal("expected OnRevoke to be called when the type changes")
+	}
+	notified = nil
+
+	if err := s.RevokeUser(id, "lost laptop"); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(notified) != string(id) {
+		t.Fatal("expected OnRevoke to be called with the revoked id")
+	}
+
+	user, err := s.FindUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !user.IsRevoked() {
+		t.Fatal("expected user to be revoked")
+	}
+
+	if user.Revocation.Reason != "lost laptop" {
+		t.Fatalf("expected reason of \"lost laptop\", got %q", user.Revocation.Reason)
+	}
+
+	if err := s.RevokeUser(id, ""); err == nil {
+		t.Fatal("expected an error revoking a user twice")
+	}
+}
+
+func TestConcurrentUpdateAndRevoke(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 20; i++ {
+		created, _, _, err := s.CreateUser(fmt.Sprintf("foo%d@email.com", i), "foo", User_PERSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := created.Id
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 2)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := s.UpdateUser(id, func(user *User) error {
+				user.Name = "bar"
+				return nil
+			})
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- s.RevokeUser(id, "lost laptop")
+		}()
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		user, err := s.FindUser(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !user.IsRevoked() {
+			t.Fatal("expected user to stay revoked")
+		}
+
+		if user.Name != "bar" {
+			t.Fatalf("expected name of bar, got %s", user.Name)
+		}
+	}
+}
+
+func TestRotateUserKey(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	created, _, keyPem, err := s.CreateUser("foo@email.com", "foo", User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := created.Id
+
+	oldKey, err := publicKeyOf(keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _, newKeyPem, err := s.RotateUserKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(user.Keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(user.Keys))
+	}
+
+	newKey, err := publicKeyOf(newKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range [][]byte{oldKey, newKey} {
+		fid, _, err := s.FindUserByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(fid) != string(id) {
+			t.Fatal("expected both keys to find the same user")
+		}
+	}
+
+	uc, err := getUserCount(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uc != 1 {
+		t.Fatalf("expected 1 user, got %d", uc)
+	}
+
+	// move the old key past its grace period.
+	user.Keys[0].Expires = 1
+	if err := s.writeUser(id, user, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.FindUserByKey(oldKey); err != ErrKeyExpired {
+		t.Fatalf("expected ErrKeyExpired, got %v", err)
+	}
+
+	if _, _, err := s.FindUserByKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthenticateOnlyLeaf(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.ECDSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	god, godCrtPem, _, err := s.CreateUser("god@email.com", "god", User_GOD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foo, fooCrtPem, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	godCrt, err := x509.ParseCertificate(godCrtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fooCrt, err := x509.ParseCertificate(fooCrtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownCrtPem, _, err := auth.GenerateCACert(auth.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownCrt, err := x509.ParseCertificate(unknownCrtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, _, err := s.Authenticate([]*x509.Certificate{godCrt}); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(id, god.Id) {
+		t.Fatal("expected the leaf to authenticate its user")
+	}
+
+	// retire foo's key.
+	user, _, _, err := s.RotateUserKey(foo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.Keys[0].Expires = 1
+	if err := s.writeUser(foo.Id, user, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// an extra, unverified cert carrying the key of another user must not
+	// stand in for a leaf that fails to authenticate.
+	for _, leaf := range []*x509.Certificate{fooCrt, unknownCrt} {
+		if _, _, err := s.Authenticate([]*x509.Certificate{
+			leaf,
+			&x509.Certificate{PublicKey: godCrt.PublicKey},
+		}); err == nil {
+			t.Fatal("expected a chain with a failing leaf to be rejected")
+		}
+	}
+
+	if _, _, err := s.Authenticate(nil); err == nil {
+		t.Fatal("expected no certs to be rejected")
+	}
+}
+
+func assertCAStatus(t *testing.T, s *Store, rotating bool, current, old int) {
+	st, err := s.CAStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Rotating != rotating || st.Current != current || st.Old != old {
+		t.Fatalf("expected rotating=%t current=%d old=%d, got %+v",
+			rotating, current, old, st)
+	}
+}
+
+func TestRotateCA(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	created, _, _, err := s.CreateUser("a@email.com", "a", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := created.Id
+
+	assertCAStatus(t, s, false, 1, 0)
+
+	if err := s.RotateCA(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCAStatus(t, s, true, 0, 1)
+
+	if _, _, _, err := s.CreateUser("b@email.com", "b", User_BOT); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCAStatus(t, s, true, 1, 1)
+
+	crtPem, err := s.ReissueUserCert(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertCAStatus(t, s, true, 2, 0)
+
+	newCAPem, err := auth.ReadPem(filepath.Join(dst, newCACrtFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newCAPool(newCAPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := x509.ParseCertificate(crtPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := crt.Verify(x509.VerifyOptions{
+		Roots:     p,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.FinishCARotation(); err != nil {
+		t.Fatal(err)
+	}
+
+	caCrtPem, err := auth.ReadPem(filepath.Join(dst, caCrtFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(caCrtPem.Bytes) != string(newCAPem.Bytes) {
+		t.Fatal("expected the new CA to become the store's CA")
+	}
+
+	assertCAStatus(t, s, false, 2, 0)
+
+	// a record without keys, as an import or restore may hold, is refused
+	// rather than reissued.
+	if _, err := s.mutateUser(id, &AuditEntry{
+		Event: AuditUserUpdated,
+	}, func(user *User) error {
+		user.Keys = nil
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ReissueUserCert(id); err == nil || !strings.Contains(err.Error(), "has no key") {
+		t.Fatalf("expected a user without keys to be refused, got %v", err)
+	}
+}
+
+func TestEncryptedCA(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	passphrase := func() ([]byte, error) {
+		return []byte("hunter2"), nil
+	}
+
+	auth.SetPassphrase(passphrase)
+	defer auth.SetPassphrase(nil)
+
+	if err := CreateEncrypted(dst, auth.ECDSA, passphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	if enc, err := auth.IsEncryptedFile(filepath.Join(dst, caKeyFile)); err != nil {
+		t.Fatal(err)
+	} else if !enc {
+		t.Fatal("expected the CA key to be encrypted")
+	}
+
+	if enc, err := auth.IsEncryptedFile(filepath.Join(dst, srvKeyFile)); err != nil {
+		t.Fatal(err)
+	} else if !enc {
+		t.Fatal("expected the server key to be encrypted")
+	}
+
+	if fi, err := os.Stat(filepath.Join(dst, srvKeyFile)); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected the server key to be private, got %s", fi.Mode())
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.CheckCAKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := s.CreateUser("a@email.com", "a", User_PERSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RotateCA(); err != nil {
+		t.Fatal(err)
+	}
+
+	if enc, err := auth.IsEncryptedFile(filepath.Join(dst, newCAKeyFile)); err != nil {
+		t.Fatal(err)
+	} else if !enc {
+		t.Fatal("expected the new CA key to be encrypted")
+	}
+
+	if _, _, _, err := s.CreateUser("b@email.com", "b", User_PERSON); err != nil {
+		t.Fatal(err)
+	}
+
+	auth.SetPassphrase(func() ([]byte, error) {
+		return []byte("hunter3"), nil
+	})
+
+	if err := s.CheckCAKey(); err == nil {
+		t.Fatal("expected the wrong passphrase to be rejected")
+	}
+}
+
+func TestUpgradeLayout(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	// recreate the layout in which the CA was also the server's cert.
+	for _, f := range [][2]string{
+		{caCrtFile, srvCrtFile},
+		{caKeyFile, srvKeyFile},
+	} {
+		if err := os.Rename(
+			filepath.Join(dst, f[0]),
+			filepath.Join(dst, f[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldPem, err := auth.ReadPem(filepath.Join(dst, srvCrtFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	caPem, err := auth.ReadPem(filepath.Join(dst, caCrtFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(caPem.Bytes) != string(oldPem.Bytes) {
+		t.Fatal("expected the previous server cert to become the CA")
+	}
+
+	srvPem, err := auth.ReadPem(filepath.Join(dst, srvCrtFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newCAPool(caPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := x509.ParseCertificate(srvPem.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := crt.Verify(x509.VerifyOptions{
+		DNSName: ServerName,
+		Roots:   p,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnrollUser(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	token, err := s.InviteUser("foo@email.com", "foo", User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uc, err := getUserCount(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uc != 0 {
+		t.Fatalf("expected pending user to not be listed, got %d users", uc)
+	}
+
+	csrPem, keyPem, err := auth.GenerateCSR(auth.RSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.EnrollUser("bogus", csrPem); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+
+	user, _, err := s.EnrollUser(token, csrPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Email != "foo@email.com" || user.Type != User_BOT {
+		t.Fatalf("unexpected user: %v", user)
+	}
+
+	key, err := publicKeyOf(keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.FindUserByKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.EnrollUser(token, csrPem); err != ErrInvalidToken {
+		t.Fatalf("expected token to be single use, got %v", err)
+	}
+}
+
+func TestGroupsAndGrants(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ids := map[string][]byte{}
+	for name, typ := range map[string]User_UserType{
+		"alice": User_PERSON,
+		"bob":   User_PERSON,
+		"god":   User_GOD,
+		"bot1":  User_BOT,
+		"bot2":  User_BOT,
+	} {
+		user, _, _, err := s.CreateUser(name+"@email.com", name, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = user.Id
+	}
+
+	if err := s.CreateGroup("ops", "operators"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateGroup("ops", ""); err == nil {
+		t.Fatal("created a duplicate group")
+	}
+
+	if err := s.AddGroupMember("ops", ids["bob"]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, g := range []*Grant{
+		{User: ids["alice"], Bot: ids["bot1"], Action: "reboot"},
+		{Group: "ops", Action: AnyAction},
+	} {
+		if err := s.AddGrant(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.AddGrant(&Grant{
+		User:   ids["alice"],
+		Bot:    ids["bob"],
+		Action: "reboot",
+	}); err == nil {
+		t.Fatal("granted an action on a person")
+	}
+
+	uc, err := getUserCount(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uc != 5 {
+		t.Fatalf("expected 5 users, got %d", uc)
+	}
+
+	assertPermits := func(who, action, bot string, expected bool) {
+		ok, err := s.Permits(ids[who], action, ids[bot])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != expected {
+			t.Fatalf("%s %s on %s: expected %t, got %t", who, action, bot, expected, ok)
+		}
+	}
+
+	assertPermits("alice", "reboot", "bot1", true)
+	assertPermits("alice", "reboot", "bot2", false)
+	assertPermits("alice", "update", "bot1", false)
+	assertPermits("bob", "update", "bot2", true)
+	assertPermits("god", "update", "bot2", true)
+
+	if err := s.RemoveGroupMember("ops", ids["bob"]); err != nil {
+		t.Fatal(err)
+	}
+	assertPermits("bob", "update", "bot2", false)
+
+	if err := s.DeleteGroup("ops"); err != nil {
+		t.Fatal(err)
+	}
+
+	var grants int
+	if err := s.ForEachGrant(func(g *Grant) error {
+		grants++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if grants != 1 {
+		t.Fatalf("expected the group's grants to be deleted, got %d grants", grants)
+	}
+
+	if err := s.RevokeUser(ids["alice"], ""); err != nil {
+		t.Fatal(err)
+	}
+	assertPermits("alice", "reboot", "bot1", false)
+}
+
+func TestApiTokens(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	user, _, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := user.Id
+
+	token, err := s.IssueToken(id, "laptop", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := s.IssueToken(id, "old", -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fid, u, err := s.FindUserByToken(token); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(fid, id) || u.Email != "foo@email.com" {
+		t.Fatalf("token found the wrong user: %s", u.Email)
+	}
+
+	for _, bad := range []string{"bogus", expired} {
+		if _, _, err := s.FindUserByToken(bad); err != ErrInvalidApiToken {
+			t.Fatalf("expected ErrInvalidApiToken, got %v", err)
+		}
+	}
+
+	var ids []string
+	if err := s.ForEachToken(func(tid string, tk *Token) error {
+		ids = append(ids, tid)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(ids))
+	}
+
+	if err := s.RevokeToken(TokenId(token)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.FindUserByToken(token); err != ErrInvalidApiToken {
+		t.Fatalf("expected ErrInvalidApiToken after revocation, got %v", err)
+	}
+}
+
+func TestForEachUserByEmail(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// created out of order, and with mixed case, to show users are visited
+	// in order of email rather than of id or creation.
+	for _, email := range []string{"c@email.com", "A@email.com", "e@email.com", "b@email.com", "D@email.com"} {
+		if _, _, _, err := s.CreateUser(email, "foo", User_PERSON); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tokens and groups sort after users and must not be visited.
+	if err := s.CreateGroup("ops", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	collect := func(after string, reverse bool) string {
+		var emails []string
+		if err := s.ForEachUserByEmail(after, reverse, func(id []byte, user *User) error {
+			emails = append(emails, user.Email[:1])
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(emails, "")
+	}
+
+	for _, test := range []struct {
+		after    string
+		reverse  bool
+		expected string
+	}{
+		{"", false, "AbcDe"},
+		{"b@email.com", false, "cDe"},
+		{"B@EMAIL.COM", false, "cDe"},
+		{"e@email.com", false, ""},
+		{"", true, "eDcbA"},
+		{"d@email.com", true, "cbA"},
+		{"a@email.com", true, ""},
+	} {
+		if actual := collect(test.after, test.reverse); actual != test.expected {
+			t.Fatalf("after %q, reverse %t: expected %s, got %s", test.after, test.reverse, test.expected, actual)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	foo, _, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fooId := foo.Id
+
+	if _, _, _, err := s.CreateUser("FOO@email.com", "other", User_PERSON); err != ErrEmailInUse {
+		t.Fatalf("expected ErrEmailInUse, got %v", err)
+	}
+
+	if _, err := s.InviteUser("foo@email.com", "foo", User_BOT); err != ErrEmailInUse {
+		t.Fatalf("expected ErrEmailInUse for an invite, got %v", err)
+	}
+
+	bar, _, _, err := s.CreateUser("bar@email.com", "foo", User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	barId := bar.Id
+
+	if id, user, err := s.FindUserByEmail("Foo@Email.com"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(id, fooId) || user.Email != "foo@email.com" {
+		t.Fatal("found the wrong user by email")
+	}
+
+	if ids, err := s.FindUsersByName("FOO"); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 2 {
+		t.Fatalf("expected 2 users named foo, got %d", len(ids))
+	}
+
+	// renaming moves the user's index entries.
+	if _, err := s.UpdateUser(barId, func(u *User) error {
+		u.Email = "baz@email.com"
+		u.Name = "baz"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.FindUserByEmail("bar@email.com"); err != ErrNoUser {
+		t.Fatalf("expected ErrNoUser for the old email, got %v", err)
+	}
+
+	if _, err := s.UpdateUser(barId, func(u *User) error {
+		u.Email = "foo@email.com"
+		return nil
+	}); err != ErrEmailInUse {
+		t.Fatalf("expected ErrEmailInUse on update, got %v", err)
+	}
+
+	if _, _, _, err := s.RotateUserKey(fooId); err != nil {
+		t.Fatal(err)
+	}
+
+	// revoking a user frees their email.
+	if err := s.RevokeUser(fooId, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.FindUserByEmail("foo@email.com"); err != ErrNoUser {
+		t.Fatalf("expected ErrNoUser for a revoked user, got %v", err)
+	}
+
+	if _, _, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems, err := s.VerifyIndexes(); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("unexpected index problems: %v", problems)
+	}
+
+	// damage the indexes and rebuild them.
+	if err := s.db.Delete(emailIndexKey("baz@email.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.db.Put(emailIndexKey("stale@email.com"), barId, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems, err := s.VerifyIndexes(); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 2 {
+		t.Fatalf("expected 2 index problems, got %v", problems)
+	}
+
+	if conflicts, err := s.RebuildIndexes(); err != nil {
+		t.Fatal(err)
+	} else if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+
+	if problems, err := s.VerifyIndexes(); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("unexpected index problems after rebuild: %v", problems)
+	}
+}
+
+// downgrade rewrites the store into the layout from before versioning: users
+// at the key they were created with, which is also how groups, grants and
+// tokens refer to them, and no indexes or schema version.
+func downgrade(t *testing.T, s *Store) {
+	var b leveldb.Batch
+	ids := map[string][]byte{}
+
+	if err := s.ForEachUser(func(id []byte, user *User) error {
+		key := user.Keys[0].Key
+		ids[string(id)] = key
+
+		user.Id = nil
+		val, err := proto.Marshal(user)
+		if err != nil {
+			return err
+		}
+
+		b.Delete(userKey(id))
+		b.Put(key, val)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	oldId := func(id []byte) []byte {
+		if key, ok := ids[string(id)]; ok {
+			return key
+		}
+		return id
+	}
+
+	if err := s.ForEachGroup(func(g *Group) error {
+		for i, m := range g.Members {
+			g.Members[i] = oldId(m)
+		}
+		val, err := proto.Marshal(g)
+		b.Put(groupKey(g.Name), val)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ForEachGrant(func(g *Grant) error {
+		b.Delete(grantKey(g))
+		g.User, g.Bot = oldId(g.User), oldId(g.Bot)
+		val, err := proto.Marshal(g)
+		b.Put(grantKey(g), val)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ForEachToken(func(tokenId string, tk *Token) error {
+		tk.User = oldId(tk.User)
+		val, err := proto.Marshal(tk)
+		b.Put(tokenKey(tokenId), val)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range indexPrefixes {
+		it := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+		for it.Next() {
+			b.Delete(append([]byte{}, it.Key()...))
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.Delete(schemaKey)
+
+	if err := s.db.Write(&b, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := s.SchemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if v != schemaVersion {
+		t.Fatalf("expected a new store at version %d, got %d", schemaVersion, v)
+	}
+
+	foo, _, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fooKey := foo.Keys[0].Key
+
+	if _, _, _, err := s.RotateUserKey(foo.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	bar, _, _, err := s.CreateUser("bar@email.com", "bar", User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	barKey := bar.Keys[0].Key
+
+	baz, _, _, err := s.CreateUser("baz@email.com", "baz", User_BOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RevokeUser(baz.Id, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateGroup("ops", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddGroupMember("ops", foo.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddGrant(&Grant{
+		Group:  "ops",
+		Bot:    bar.Id,
+		Action: "deploy",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.IssueToken(foo.Id, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downgrade(t, s)
+	s.Close()
+
+	if s, err = Open(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := s.SchemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if v != schemaVersion {
+		t.Fatalf("expected version %d after migrating, got %d", schemaVersion, v)
+	}
+
+	if n, err := getUserCount(s); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("expected 3 users after migrating, got %d", n)
+	}
+
+	fooId, user, err := s.FindUserByEmail("foo@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fooId) != userIdSize || !bytes.Equal(user.Id, fooId) {
+		t.Fatalf("expected a new id, got %x", fooId)
+	}
+
+	for _, k := range user.Keys {
+		if id, _, err := s.FindUserByKey(k.Key); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(id, fooId) {
+			t.Fatal("found the wrong user by key")
+		}
+	}
+
+	if _, err := s.FindUser(fooKey); err != ErrNoUser {
+		t.Fatalf("expected the user's key to no longer be its id, got %v", err)
+	}
+
+	barId, _, err := s.FindUserByKey(barKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := s.Permits(fooId, "deploy", barId); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected the group grant to survive migrating")
+	}
+
+	if id, _, err := s.FindUserByToken(token); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(id, fooId) {
+		t.Fatal("expected the token to belong to the migrated user")
+	}
+
+	if problems, err := s.VerifyIndexes(); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("unexpected index problems after migrating: %v", problems)
+	}
+
+	// stores from newer code are refused rather than misread.
+	if err := s.writeSchemaVersion(schemaVersion + 1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if _, err := Open(dst); err == nil {
+		t.Fatal("expected a store at a newer version to be refused")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.UpdateUser(user.Id, func(u *User) error {
+		u.Name = "bar"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries written after reopening the store continue the chain.
+	s.Close()
+	if s, err = Open(dst); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.RevokeUser(user.Id, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	if err := s.ForEachAuditEntry(0, func(e *AuditEntry) error {
+		if !bytes.Equal(e.Subject, user.Id) {
+			t.Fatalf("entry %d is not about the user", e.Seq)
+		}
+		events = append(events, e.Event)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(events) != fmt.Sprint([]string{AuditUserCreated, AuditUserUpdated, AuditUserRevoked}) {
+		t.Fatalf("unexpected events: %v", events)
+	}
+
+	n, head, err := s.VerifyAudit()
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 3 || head == "" {
+		t.Fatalf("expected 3 entries and a digest, got %d, %q", n, head)
+	}
+
+	// altering an entry breaks the link from the one after it.
+	val, err := s.db.Get(auditKey(2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e AuditEntry
+	if err := proto.Unmarshal(val, &e); err != nil {
+		t.Fatal(err)
+	}
+	e.Detail = "nothing to see here"
+
+	if val, err = proto.Marshal(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.db.Put(auditKey(2), val, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.VerifyAudit(); err == nil {
+		t.Fatal("expected an altered entry to be detected")
+	}
+
+	// as does removing one.
+	if err := s.db.Delete(auditKey(2), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.VerifyAudit(); err == nil {
+		t.Fatal("expected a removed entry to be detected")
+	}
+}
+
+func TestAuditTruncation(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := s.Audit(&AuditEntry{Event: AuditBackup}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := s.VerifyAudit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the end of the log leaves an intact chain, but not the
+	// entry the head file records.
+	if err := s.db.Delete(auditKey(3), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.VerifyAudit(); err == nil || !strings.Contains(err.Error(), "ends at entry 2") {
+		t.Fatalf("expected the truncation to be detected, got %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries written after reopening do not cover it up.
+	if s, err = Open(dst); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := s.Audit(&AuditEntry{Event: AuditBackup}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := s.VerifyAudit(); err == nil || !strings.Contains(err.Error(), "entry 3 differs") {
+		t.Fatalf("expected the rewritten entry to be detected, got %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dst, auditHeadFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.VerifyAudit(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected the missing head file to be detected, got %v", err)
+	}
+}
+
+func TestAuditAdminChanges(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	user, _, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.IssueToken(user.Id, "ci", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RevokeToken(TokenId(token)); err != nil {
+		t.Fatal(err)
+	}
+
+	grant := &Grant{
+		User:   user.Id,
+		Action: AnyAction,
+	}
+
+	for _, f := range []func() error{
+		func() error { return s.CreateGroup("ops", "") },
+		func() error { return s.AddGroupMember("ops", user.Id) },
+		func() error { return s.AddGrant(grant) },
+		func() error { return s.RemoveGrant(grant) },
+		func() error { return s.RemoveGroupMember("ops", user.Id) },
+		func() error { return s.DeleteGroup("ops") },
+		s.RotateCA,
+		s.FinishCARotation,
+		s.IssueServerCert,
+	} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var events []string
+	if err := s.ForEachAuditEntry(1, func(e *AuditEntry) error {
+		events = append(events, e.Event)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		AuditTokenIssued,
+		AuditTokenRevoked,
+		AuditGroupCreated,
+		AuditGroupMemberAdded,
+		AuditGrantAdded,
+		AuditGrantRemoved,
+		AuditGroupMemberRemoved,
+		AuditGroupDeleted,
+		AuditCARotated,
+		AuditCARotationFinished,
+		AuditServerCertIssued,
+	}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+}
+
+func TestAuditAuthFailureThrottled(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dst := filepath.Join(tmp, "data")
+
+	if err := Create(dst, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, addr := range []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.1:3", "10.0.0.2:1"} {
+		if err := s.AuditAuthFailure(addr, nil, ErrNoUser); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the window has passed for the first host.
+	s.authFailures["10.0.0.1"].since = time.Now().Add(-authFailureWindow)
+	if err := s.AuditAuthFailure("10.0.0.1:4", nil, ErrNoUser); err != nil {
+		t.Fatal(err)
+	}
+
+	var details []string
+	if err := s.ForEachAuditEntry(0, func(e *AuditEntry) error {
+		if e.Event == AuditAuthFailure {
+			details = append(details, e.RemoteAddr+" "+e.Detail)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"10.0.0.1:1 " + ErrNoUser.Error(),
+		"10.0.0.2:1 " + ErrNoUser.Error(),
+		"10.0.0.1:4 " + ErrNoUser.Error() + " (2 earlier failures not audited)",
+	}
+	if fmt.Sprint(details) != fmt.Sprint(expected) {
+		t.Fatalf("expected %q, got %q", expected, details)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "data")
+
+	if err := Create(src, auth.RSA); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	user, _, _, err := s.CreateUser("foo@email.com", "foo", User_PERSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.IssueToken(user.Id, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := s.Backup(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes after the backup are not in it.
+	if _, _, _, err := s.CreateUser("bar@email.com", "bar", User_PERSON); err != nil {
+		t.Fatal(err)
+	}
+
+	// a truncated archive is rejected without leaving anything behind.
+	bad := filepath.Join(tmp, "bad")
+	if err := Restore(bytes.NewReader(b.Bytes()[:b.Len()/2]), bad); err == nil {
+		t.Fatal("expected a truncated backup to be rejected")
+	}
+
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing at %s, got %v", bad, err)
+	}
+
+	if err := Restore(bytes.NewReader(b.Bytes()), src); err == nil {
+		t.Fatal("expected restoring over an existing store to fail")
+	}
+
+	dst := filepath.Join(tmp, "restored")
+	if err := Restore(bytes.NewReader(b.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if n, err := getUserCount(r); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected 1 user, got %d", n)
+	}
+
+	if id, _, err := r.FindUserByToken(token); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(id, user.Id) {
+		t.Fatal("expected the token to belong to the restored user")
+	}
+
+	srcCA, err := s.CACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstCA, err := r.CACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(srcCA.Bytes, dstCA.Bytes) {
+		t.Fatal("expected the restored store to have the same CA")
+	}
+
+	var last string
+	if err := r.ForEachAuditEntry(0, func(e *AuditEntry) error {
+		last = e.Event
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if last != AuditRestored {
+		t.Fatalf("expected the restore to be audited last, got %s", last)
+	}
+
+	if _, _, err := r.VerifyAudit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadCorruptDump(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	db, err := leveldb.OpenFile(filepath.Join(tmp, "db"), &opt.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var b [binary.MaxVarintLen64]byte
+	for _, size := range []uint64{1 << 62, 64} {
+		dump := append(b[:binary.PutUvarint(b[:], size)], "short"...)
+
+		_, err := readDump(bufio.NewReader(bytes.NewReader(dump)), int64(len(dump)), db)
+		if err == nil || !strings.Contains(err.Error(), "corrupt dump: record of") {
+			t.Fatalf("%d: expected a corrupt dump, got %v", size, err)
+		}
+	}
+}
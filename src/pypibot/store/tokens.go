@@ -0,0 +1,166 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var tokenPrefix = []byte("token:")
+
+// ErrInvalidApiToken is returned when an api token is unknown, has been
+// revoked or has expired.
+var ErrInvalidApiToken = errors.New("invalid api token")
+
+// TokenId returns the id by which a token is listed and revoked, which is
+// the start of its digest.
+func TokenId(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:8])
+}
+
+func tokenKey(tokenId string) []byte {
+	return append(append([]byte{}, tokenPrefix...), tokenId...)
+}
+
+// IssueToken creates a bearer token for the user identified by id. A
+// lifetime of zero means the token does not expire. Only a digest of the
+// token is stored, so it cannot be recovered later.
+func (s *Store) IssueToken(id []byte, name string, lifetime time.Duration) (string, error) {
+	user, err := s.FindUser(id)
+	if err != nil {
+		return "", err
+	}
+
+	if user.IsRevoked() {
+		return "", errors.New("user is revoked")
+	}
+
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b[:])
+
+	now := time.Now()
+	h := sha256.Sum256([]byte(token))
+	t := &Token{
+		User:    id,
+		Name:    name,
+		Created: now.Unix(),
+		Digest:  h[:],
+	}
+
+	if lifetime != 0 {
+		t.Expires = now.Add(lifetime).Unix()
+	}
+
+	val, err := proto.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	var batch leveldb.Batch
+	batch.Put(tokenKey(TokenId(token)), val)
+
+	if err := s.writeAudited(&batch, &AuditEntry{
+		Event:   AuditTokenIssued,
+		Subject: id,
+		Detail:  fmt.Sprintf("%s %s", TokenId(token), name),
+	}); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// RevokeToken deletes the token with the given id.
+func (s *Store) RevokeToken(tokenId string) error {
+	var ro opt.ReadOptions
+	val, err := s.db.Get(tokenKey(tokenId), &ro)
+	if err == leveldb.ErrNotFound {
+		return errors.New("no such token")
+	} else if err != nil {
+		return err
+	}
+
+	var t Token
+	if err := proto.Unmarshal(val, &t); err != nil {
+		return err
+	}
+
+	var b leveldb.Batch
+	b.Delete(tokenKey(tokenId))
+
+	return s.writeAudited(&b, &AuditEntry{
+		Event:   AuditTokenRevoked,
+		Subject: t.User,
+		Detail:  fmt.Sprintf("%s %s", tokenId, t.Name),
+	})
+}
+
+// FindUserByToken returns the id of the user a token was issued to along
+// with the user.
+func (s *Store) FindUserByToken(token string) ([]byte, *User, error) {
+	var ro opt.ReadOptions
+	val, err := s.db.Get(tokenKey(TokenId(token)), &ro)
+	if err == leveldb.ErrNotFound {
+		return nil, nil, ErrInvalidApiToken
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var t Token
+	if err := proto.Unmarshal(val, &t); err != nil {
+		return nil, nil, err
+	}
+
+	h := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(h[:], t.Digest) != 1 {
+		return nil, nil, ErrInvalidApiToken
+	}
+
+	if t.Expires != 0 && t.Expires < time.Now().Unix() {
+		return nil, nil, ErrInvalidApiToken
+	}
+
+	user, err := s.FindUser(t.User)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if user.IsRevoked() {
+		return nil, nil, ErrInvalidApiToken
+	}
+
+	return t.User, user, nil
+}
+
+// ForEachToken calls f with the id of every token along with the token.
+func (s *Store) ForEachToken(f func(string, *Token) error) error {
+	var ro opt.ReadOptions
+	it := s.db.NewIterator(util.BytesPrefix(tokenPrefix), &ro)
+	defer it.Release()
+
+	for it.Next() {
+		var t Token
+		if err := proto.Unmarshal(it.Value(), &t); err != nil {
+			return err
+		}
+
+		if err := f(string(it.Key()[len(tokenPrefix):]), &t); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}